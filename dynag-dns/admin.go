@@ -0,0 +1,301 @@
+package main
+
+import "encoding/json"
+import "errors"
+import "log"
+import "net/http"
+import "os"
+import "sort"
+import "strings"
+import "time"
+import "github.com/miekg/dns"
+
+type Override struct {
+	// Forces a record up or down, until `Expires` (if set)
+	Enabled		bool		`json:"enabled"`
+	Expires		*time.Time	`json:"expires,omitempty"`
+}
+
+type RecordStatus struct {
+	Record		string		`json:"record"`
+	Name		string		`json:"name"`
+	Type		string		`json:"type"`
+	Enabled		bool		`json:"enabled"`
+	Stale		bool		`json:"stale"`
+	Served		bool		`json:"served"`
+	Tier		int		`json:"tier"`
+	Checked		bool		`json:"checked"`
+	LastCheck	*time.Time	`json:"last_check,omitempty"`
+	LastResult	*bool		`json:"last_result,omitempty"`
+	LastOutput	string		`json:"last_output,omitempty"`
+	LastChange	*time.Time	`json:"last_change,omitempty"`
+	LatencyMs	float64		`json:"latency_ms"`
+	Counters	string		`json:"counters,omitempty"`
+	Override	*Override	`json:"override,omitempty"`
+}
+
+type overrideRequest struct {
+	Record		string		`json:"record"`
+	Enabled		bool		`json:"enabled"`
+	Duration	int		`json:"duration"`
+}
+
+type AdminServer struct {
+	Store		*RecordStore
+	Token		string
+}
+
+func (record *DynRR) Active (now time.Time) (bool) {
+	// An override wins over the health check. Expired overrides are
+	// removed by the store (see ExpireOverrides).
+	if record.Override != nil { return record.Override.Enabled }
+
+	// Restored state is only used if configured (see LoadState)
+	if record.Stale && !serveStale { return false }
+	return record.Enabled
+}
+
+func RecordKey (rr dns.RR) (string) {
+	// Identifies a record independent of its TTL and our runtime UUIDs,
+	// e.g. "www.example.org. A 192.0.2.1"
+	header := rr.Header()
+	rdata := strings.TrimPrefix(rr.String(), header.String())
+	return dns.CanonicalName(header.Name) + " " + dns.TypeToString[header.Rrtype] + " " + rdata
+}
+
+func (s *RecordStore) Status () ([]RecordStatus) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var result []RecordStatus
+	for qname := range s.data {
+		for qtype, records := range s.data[qname] {
+			served := servedRRs(records)
+			for _, record := range records {
+				status := RecordStatus{Record: RecordKey(record.Data),
+						       Name: qname,
+						       Type: dns.TypeToString[qtype],
+						       Enabled: record.Enabled,
+						       Stale: record.Stale,
+						       Served: containsRR(served, record.Data),
+						       Tier: record.Tier,
+						       Checked: record.Uuid != "",
+						       Override: record.Override}
+
+				if !record.LastCheck.IsZero() {
+					lastcheck := record.LastCheck
+					lastresult := record.Successes > 0
+					status.LastCheck = &lastcheck
+					status.LastResult = &lastresult
+					status.LastOutput = record.LastOutput
+					status.LatencyMs = float64(record.Latency.Microseconds()) / 1000
+					status.Counters = record.Counters()
+				}
+				if !record.LastChange.IsZero() {
+					lastchange := record.LastChange
+					status.LastChange = &lastchange
+				}
+
+				result = append(result, status)
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Record < result[j].Record })
+	return result
+}
+
+func (s *RecordStore) SetOverride (key string, override *Override) (error) {
+	// Sets (or with nil, removes) the override for all records matching `key`
+	return s.setOverride(key, override, true)
+}
+
+func (s *RecordStore) setOverride (key string, override *Override, notify bool) (error) {
+	// Hooks are not told about overrides restored at startup
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	found := false
+	for qname := range s.data {
+		for qtype, records := range s.data[qname] {
+			for _, record := range records {
+				if RecordKey(record.Data) != key { continue }
+				found = true
+
+				before := servedRRs(records)
+				active := record.Active(time.Now())
+				record.Override = override
+				output := "Override removed"
+				if override == nil {
+					log.Printf("Override removed for %s\n", key)
+				} else {
+					log.Printf("Override for %s set to %s\n", key, UpBool(override.Enabled))
+					output = "Override set to " + StateName(override.Enabled)
+				}
+				s.changed(qname, qtype, before)
+				if notify { s.fireOverride(qname, qtype, record, active, output) }
+			}
+		}
+	}
+	if !found { return errors.New("No such record: " + key) }
+
+	if override != nil && override.Expires != nil {
+		time.AfterFunc(time.Until(*override.Expires), s.ExpireOverrides)
+	}
+
+	return s.saveOverrides()
+}
+
+func (s *RecordStore) ExpireOverrides () {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	expired := false
+	for qname := range s.data {
+		for qtype, records := range s.data[qname] {
+			for _, record := range records {
+				if record.Override == nil || record.Override.Expires == nil || now.Before(*record.Override.Expires) { continue }
+				expired = true
+
+				before := servedRRs(records)
+				active := record.Active(now)
+				record.Override = nil
+				log.Printf("Override expired for %s\n", RecordKey(record.Data))
+				s.changed(qname, qtype, before)
+				s.fireOverride(qname, qtype, record, active, "Override expired")
+			}
+		}
+	}
+
+	if expired {
+		if err := s.saveOverrides(); err != nil { log.Printf("Failed to save overrides: %s\n", err) }
+	}
+}
+
+func (s *RecordStore) fireOverride (qname string, qtype uint16, record *DynRR, before bool, output string) {
+	// Tells the hooks if an override changed the status of a record.
+	// Called with the write lock held.
+	now := time.Now()
+	if s.Hooks == nil || record.Active(now) == before { return }
+	s.Hooks.Fire(StateChange{Record: RecordKey(record.Data),
+				 Name: qname,
+				 Type: dns.TypeToString[qtype],
+				 OldState: StateName(before),
+				 NewState: StateName(!before),
+				 Output: output,
+				 Served: len(servedRRs(s.data[qname][qtype])),
+				 Time: now})
+}
+
+func (s *RecordStore) saveOverrides () (error) {
+	// Called with the write lock held. Writes all overrides to
+	// `OverrideFile`, so they survive a restart.
+	if s.OverrideFile == "" { return nil }
+
+	overrides := make(map[string]*Override)
+	for qname := range s.data {
+		for _, records := range s.data[qname] {
+			for _, record := range records {
+				if record.Override != nil { overrides[RecordKey(record.Data)] = record.Override }
+			}
+		}
+	}
+
+	content, err := json.MarshalIndent(overrides, "", "  ")
+	if err != nil { return err }
+
+	// Write to a temporary file first, so we never leave a broken file
+	if err := os.WriteFile(s.OverrideFile + ".tmp", content, 0600); err != nil { return err }
+	return os.Rename(s.OverrideFile + ".tmp", s.OverrideFile)
+}
+
+func (s *RecordStore) LoadOverrides () (error) {
+	// Restores overrides saved by a previous run
+	if s.OverrideFile == "" { return nil }
+
+	content, err := os.ReadFile(s.OverrideFile)
+	if os.IsNotExist(err) { return nil }
+	if err != nil { return err }
+
+	overrides := make(map[string]*Override)
+	if err := json.Unmarshal(content, &overrides); err != nil { return err }
+
+	now := time.Now()
+	for key, override := range overrides {
+		if override.Expires != nil && now.After(*override.Expires) { continue }
+		if err := s.setOverride(key, override, false); err != nil {
+			log.Printf("Dropping override: %s\n", err)
+		}
+	}
+
+	// Records which no longer exist are gone from the file now
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saveOverrides()
+}
+
+func (a *AdminServer) ListenAndServe (listen string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", a.handleStatus)
+	mux.HandleFunc("/override", a.handleOverride)
+	mux.Handle("/metrics", MetricsHandler())
+
+	log.Printf("Admin interface listening on %s\n", listen)
+	log.Println(http.ListenAndServe(listen, mux))
+}
+
+func (a *AdminServer) handleStatus (w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.Store.Status())
+}
+
+func (a *AdminServer) handleOverride (w http.ResponseWriter, r *http.Request) {
+	// Changes require the token, if one is configured
+	if a.Token != "" && r.Header.Get("Authorization") != "Bearer " + a.Token {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		// {"record": "www.example.org. A 192.0.2.1", "enabled": false, "duration": 3600}
+		var request overrideRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		override := &Override{Enabled: request.Enabled}
+		if request.Duration > 0 {
+			expires := time.Now().Add(seconds(request.Duration)).UTC()
+			override.Expires = &expires
+		}
+
+		if err := a.Store.SetOverride(request.Record, override); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, override)
+
+	case http.MethodDelete:
+		// The record is given as parameter, e.g. /override?record=...
+		if err := a.Store.SetOverride(r.URL.Query().Get("record"), nil); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON (w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil { log.Println(err) }
+}
@@ -0,0 +1,153 @@
+package main
+
+import "errors"
+import "math"
+import "math/rand"
+import "sort"
+import "strconv"
+import "sync"
+import "sync/atomic"
+import "github.com/miekg/dns"
+import config "github.com/olebedev/config"
+
+// Largest UDP response we send, see SignAnswer
+const maxUDPSize = 1220
+
+type AnswerConf struct {
+	// The `answers` section: order of the records in each
+	// response ("config", "roundrobin" or "random") and
+	// the maximum number of records per response (0 for all)
+	Order		string
+	Max		int
+}
+
+// Round robin position for each name and type
+var rotation sync.Map
+
+func LoadAnswerConf (cfg *config.Config) (AnswerConf, error) {
+	conf := AnswerConf{Order: cfg.UString("answers.order", "config"), Max: cfg.UInt("answers.max", 0)}
+	switch conf.Order {
+	case "config", "roundrobin", "random":
+	default:
+		return conf, errors.New("Invalid order for answers: " + conf.Order)
+	}
+	if conf.Max < 0 { return conf, errors.New("Invalid maximum for answers: " + strconv.Itoa(conf.Max)) }
+	return conf, nil
+}
+
+func (c AnswerConf) Arrange (records []*DynRR) ([]dns.RR) {
+	// Orders the served records of a name and type for a single
+	// response and applies the limit. Records with weight 0 are
+	// only used if no other record is served.
+	var weighted []*DynRR
+	for _, record := range records {
+		if record.Weight > 0 { weighted = append(weighted, record) }
+	}
+	if len(weighted) == 0 { weighted = append(weighted, records...) }
+
+	switch c.Order {
+	case "roundrobin":
+		weighted = rotate(weighted)
+	case "random":
+		weighted = shuffle(weighted)
+	}
+
+	if c.Max > 0 && len(weighted) > c.Max { weighted = weighted[:c.Max] }
+
+	var result []dns.RR
+	for _, record := range weighted { result = append(result, record.Data) }
+	return result
+}
+
+func weight (record *DynRR) (int) {
+	// All records weigh the same if none has a weight
+	if record.Weight < 1 { return 1 }
+	return record.Weight
+}
+
+func rotate (records []*DynRR) ([]*DynRR) {
+	// Every response starts with the next record, records with
+	// a higher weight come first in more responses
+	if len(records) < 2 { return records }
+
+	total := 0
+	for _, record := range records { total += weight(record) }
+
+	header := records[0].Data.Header()
+	key := header.Name + "/" + strconv.Itoa(int(header.Rrtype))
+	counter, _ := rotation.LoadOrStore(key, new(uint64))
+	position := int((atomic.AddUint64(counter.(*uint64), 1) - 1) % uint64(total))
+
+	start := 0
+	for i, record := range records {
+		position -= weight(record)
+		if position < 0 { start = i; break }
+	}
+
+	result := append([]*DynRR{}, records[start:]...)
+	return append(result, records[:start]...)
+}
+
+func shuffle (records []*DynRR) ([]*DynRR) {
+	// Weighted random order (Efraimidis and Spirakis): every record
+	// gets a random key which tends to be lower for higher weights
+	keys := make(map[*DynRR]float64)
+	for _, record := range records { keys[record] = -math.Log(1 - rand.Float64()) / float64(weight(record)) }
+
+	result := append([]*DynRR{}, records...)
+	sort.Slice(result, func(i, j int) bool { return keys[result[i]] < keys[result[j]] })
+	return result
+}
+
+func udpSize (query *dns.Msg) (int) {
+	// The size the client can receive (RFC 6891, 6.2.5), but
+	// not more than we announce ourselves
+	opt := query.IsEdns0()
+	if opt == nil { return dns.MinMsgSize }
+	size := int(opt.UDPSize())
+	if size < dns.MinMsgSize { size = dns.MinMsgSize }
+	if size > maxUDPSize { size = maxUDPSize }
+	return size
+}
+
+func Truncate (answer *dns.Msg, size int) {
+	// Makes a UDP response fit into `size`. Additional records are
+	// optional and dropped first, without setting TC. If the answer
+	// and authority sections don't fit, only the header, question
+	// and OPT are sent with TC set, so the client retries over TCP
+	// (RFC 2181, 9). RRsets are never split.
+	if answer.Len() <= size { return }
+	answer.Compress = true
+	if answer.Len() <= size { return }
+
+	opt := answer.IsEdns0()
+	var extra []dns.RR
+	for _, rr := range answer.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT { extra = append(extra, rr) }
+	}
+
+	// Remove whole RRsets (with their signatures) from the end
+	for len(extra) > 0 {
+		last := extra[len(extra) - 1].Header()
+		name, rrtype := dns.CanonicalName(last.Name), coveredType(extra[len(extra) - 1])
+		for len(extra) > 0 {
+			rr := extra[len(extra) - 1]
+			if dns.CanonicalName(rr.Header().Name) != name || coveredType(rr) != rrtype { break }
+			extra = extra[:len(extra) - 1]
+		}
+
+		answer.Extra = append([]dns.RR{}, extra...)
+		if opt != nil { answer.Extra = append(answer.Extra, opt) }
+		if answer.Len() <= size { return }
+	}
+
+	answer.Truncated = true
+	answer.Answer = nil
+	answer.Ns = nil
+}
+
+func coveredType (rr dns.RR) (uint16) {
+	// Signatures belong to the RRset they cover
+	if sig, ok := rr.(*dns.RRSIG); ok { return sig.TypeCovered }
+	return rr.Header().Rrtype
+}
@@ -0,0 +1,90 @@
+package main
+
+import "log"
+import "sync"
+import "time"
+
+type Check struct {
+	// A health check for `Record`, run every `Interval`
+	Record		*DynRR
+	Probe		Probe
+	Interval	time.Duration
+	next		time.Time
+	running		bool
+}
+
+type CheckTable struct {
+	// The running health checks, indexed by the UUID of their record.
+	// A single scheduler job starts the checks which are due, so checks
+	// can be added, removed or retuned at any time (see Sync).
+	mutex		sync.Mutex
+	checks		map[string]*Check
+}
+
+// The health checks of all records
+var checks = NewCheckTable()
+
+func NewCheckTable () (*CheckTable) {
+	return &CheckTable{checks: make(map[string]*Check)}
+}
+
+func (t *CheckTable) Sync (wanted []*Check) {
+	// Replaces the running checks with `wanted`. Checks for records
+	// which kept their UUID continue on their schedule, new ones run
+	// immediately and checks which are not wanted anymore stop.
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	current := make(map[string]*Check)
+	added, retuned := 0, 0
+	for _, check := range wanted {
+		uuid := check.Record.Uuid
+		if old, ok := t.checks[uuid]; ok {
+			check.next = old.next
+			check.running = old.running
+			if old.Interval != check.Interval {
+				retuned++
+				if check.next.After(now.Add(check.Interval)) { check.next = now.Add(check.Interval) }
+			}
+		} else {
+			added++
+		}
+		current[uuid] = check
+	}
+
+	removed := 0
+	for uuid := range t.checks {
+		if _, ok := current[uuid]; !ok { removed++ }
+	}
+	t.checks = current
+
+	if added + retuned + removed > 0 {
+		log.Printf("Health checks: %d added, %d retuned, %d removed, %d total\n", added, retuned, removed, len(current))
+	}
+}
+
+func (t *CheckTable) RunDue () {
+	// Start all checks which are due and not still running
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	for uuid, check := range t.checks {
+		if check.running || now.Before(check.next) { continue }
+		check.running = true
+		check.next = now.Add(check.Interval)
+
+		go func(probe Probe, uuid string) {
+			run_check(probe, uuid)
+			t.finished(uuid)
+		}(check.Probe, uuid)
+	}
+}
+
+func (t *CheckTable) finished (uuid string) {
+	// The check may have been replaced (or removed) meanwhile
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if check, ok := t.checks[uuid]; ok { check.running = false }
+}
@@ -0,0 +1,339 @@
+package main
+
+import "encoding/base32"
+import "errors"
+import "log"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+import "github.com/miekg/dns"
+
+// Signatures are valid for a week (plus an hour of clock skew on the
+// inception side) and are re-created once less than half of that is left
+const sigValidity = 7 * 24 * time.Hour
+const sigSkew = time.Hour
+const sigRefresh = sigValidity / 2
+
+// TTL for synthesized NSEC/NSEC3 records
+const defaultDenialTTL = 60
+
+// Cached signatures per signer. Limited answers (see Arrange) can create
+// many variants of an RRset, so unused entries are dropped when full.
+const sigCacheSize = 10000
+const sigCacheIdle = time.Hour
+
+type cachedSig struct {
+	Sig		*dns.RRSIG
+	Used		time.Time
+}
+
+type ZoneSigner struct {
+	Name		string
+	Keys		DNSSECconf
+	NSEC3		bool
+	DenialTTL	uint32
+	mutex		sync.Mutex
+	cache		map[string]*cachedSig
+}
+
+// All names which carry their own keys, indexed by name
+var signers = make(map[string]*ZoneSigner)
+
+func NewZoneSigner (name string, keys DNSSECconf, nsec3 bool) (*ZoneSigner) {
+	return &ZoneSigner{Name: dns.CanonicalName(name),
+			   Keys: keys,
+			   NSEC3: nsec3,
+			   DenialTTL: defaultDenialTTL,
+			   cache: make(map[string]*cachedSig)}
+}
+
+func FindSigner (name string) (*ZoneSigner) {
+	// Walk up the tree until we find a name with keys
+	name = dns.CanonicalName(name)
+	for {
+		if signer, ok := signers[name]; ok { return signer }
+		if name == "." { return nil }
+		next, end := dns.NextLabel(name, 0)
+		if end { return nil }
+		name = name[next:]
+	}
+}
+
+func (z *ZoneSigner) Invalidate (name string) {
+	// Drop all cached signatures for `name`, e.g. after a status change
+	prefix := dns.CanonicalName(name) + "/"
+
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	for key := range z.cache {
+		if strings.HasPrefix(key, prefix) { delete(z.cache, key) }
+	}
+}
+
+func (z *ZoneSigner) SignRRset (rrset []dns.RR) (*dns.RRSIG, error) {
+	if len(rrset) == 0 { return nil, errors.New("Empty RRset") }
+	header := rrset[0].Header()
+	// The TTL is part of the key, as the SOA is served with different
+	// TTLs in positive and negative answers. So is the fingerprint, as
+	// limited answers (see Arrange) contain different parts of an RRset.
+	fingerprint := rrsetFingerprint(rrset)
+	key := dns.CanonicalName(header.Name) + "/" + strconv.Itoa(int(header.Rrtype)) + "/" + strconv.Itoa(int(header.Ttl)) + "/" + fingerprint
+
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+
+	// Re-use a cached signature as long as it has enough validity left
+	now := time.Now()
+	if cached, ok := z.cache[key]; ok && !cached.expiring(now) {
+		cached.Used = now
+		return cached.Sig, nil
+	}
+
+	sig, err := z.sign(rrset)
+	if err != nil { return nil, err }
+
+	if _, ok := z.cache[key]; !ok && len(z.cache) >= sigCacheSize { z.prune(now) }
+	z.cache[key] = &cachedSig{Sig: sig, Used: now}
+	return sig, nil
+}
+
+func (c *cachedSig) expiring (now time.Time) (bool) {
+	return time.Unix(int64(c.Sig.Expiration), 0).Sub(now) <= sigRefresh
+}
+
+func (z *ZoneSigner) prune (now time.Time) {
+	// Drops signatures which would be re-created anyway or were not used
+	// for a while. If the cache is still too full, the least recently
+	// used quarter goes as well. The caller holds the mutex.
+	for key, cached := range z.cache {
+		if cached.expiring(now) || now.Sub(cached.Used) > sigCacheIdle { delete(z.cache, key) }
+	}
+	if len(z.cache) < sigCacheSize { return }
+
+	keys := make([]string, 0, len(z.cache))
+	for key := range z.cache { keys = append(keys, key) }
+	sort.Slice(keys, func(i, j int) bool { return z.cache[keys[i]].Used.Before(z.cache[keys[j]].Used) })
+	for _, key := range keys[:len(keys) / 4] { delete(z.cache, key) }
+}
+
+func (z *ZoneSigner) sign (rrset []dns.RR) (*dns.RRSIG, error) {
+	// The DNSKEY set is signed with the KSK, everything else with the ZSK
+	dnskey, signer := z.Keys.ZSK.DnsKey, z.Keys.ZSK.Signer
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		dnskey, signer = z.Keys.KSK.DnsKey, z.Keys.KSK.Signer
+	}
+	if dnskey == nil || signer == nil { return nil, errors.New("No key available for " + z.Name) }
+
+	now := time.Now()
+	sig := &dns.RRSIG{Hdr: dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+			  Algorithm: dnskey.Algorithm,
+			  KeyTag: dnskey.KeyTag(),
+			  SignerName: z.Name,
+			  Inception: uint32(now.Add(-sigSkew).Unix()),
+			  Expiration: uint32(now.Add(sigValidity).Unix())}
+
+	return sig, sig.Sign(signer, rrset)
+}
+
+func (z *ZoneSigner) SignSection (section []dns.RR) ([]dns.RR) {
+	return z.signSection(section, true)
+}
+
+func (z *ZoneSigner) signSection (section []dns.RR, cached bool) ([]dns.RR) {
+	// Group the section into RRsets (keeping their order) and
+	// append a signature after each of them
+	var order []string
+	rrsets := make(map[string][]dns.RR)
+	for _, rr := range section {
+		key := dns.CanonicalName(rr.Header().Name) + "/" + strconv.Itoa(int(rr.Header().Rrtype))
+		if _, ok := rrsets[key]; !ok { order = append(order, key) }
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	var result []dns.RR
+	for _, key := range order {
+		result = append(result, rrsets[key]...)
+		var sig *dns.RRSIG
+		var err error
+		if cached {
+			sig, err = z.SignRRset(rrsets[key])
+		} else {
+			sig, err = z.sign(rrsets[key])
+		}
+		if err != nil {
+			log.Printf("Failed to sign %s: %s\n", key, err)
+			continue
+		}
+		result = append(result, sig)
+	}
+
+	return result
+}
+
+func (z *ZoneSigner) Denial (dnsdata map[string]map[uint16][]*DynRR, qname string, nxdomain bool) ([]dns.RR) {
+	// Synthesize signed NSEC/NSEC3 records proving that `qname` (or the
+	// requested type at `qname`) does not exist, see RFC 4470 and RFC 7129
+	qname = dns.CanonicalName(qname)
+	var denial []dns.RR
+
+	if z.NSEC3 {
+		if nxdomain {
+			// Closest encloser proof plus wildcard denial (RFC 5155, 7.2.1)
+			closest, nextcloser := closestEncloser(dnsdata, z.Name, qname)
+			denial = append(denial, z.nsec3Match(closest, typeBitmap(dnsdata, closest, true)))
+			denial = append(denial, z.nsec3Cover(nextcloser))
+			denial = appendUnique(denial, z.nsec3Cover("*." + closest))
+		} else {
+			denial = append(denial, z.nsec3Match(qname, typeBitmap(dnsdata, qname, true)))
+		}
+	} else {
+		if nxdomain {
+			closest, _ := closestEncloser(dnsdata, z.Name, qname)
+			denial = append(denial, z.nsecCover(qname))
+			denial = appendUnique(denial, z.nsecCover("*." + closest))
+		} else {
+			denial = append(denial, &dns.NSEC{Hdr: z.denialHeader(qname, dns.TypeNSEC),
+							  NextDomain: "\\000." + qname,
+							  TypeBitMap: typeBitmap(dnsdata, qname, false)})
+		}
+	}
+
+	// Synthesized records differ for every qname, so they are not cached
+	return z.signSection(denial, false)
+}
+
+func (z *ZoneSigner) denialHeader (owner string, rrtype uint16) (dns.RR_Header) {
+	return dns.RR_Header{Name: owner, Rrtype: rrtype, Class: dns.ClassINET, Ttl: z.DenialTTL}
+}
+
+func (z *ZoneSigner) nsecCover (name string) (dns.RR) {
+	// An NSEC record with a minimal range around `name`
+	return &dns.NSEC{Hdr: z.denialHeader(prevName(name), dns.TypeNSEC),
+			 NextDomain: "\\000." + name,
+			 TypeBitMap: []uint16{dns.TypeRRSIG, dns.TypeNSEC}}
+}
+
+func (z *ZoneSigner) nsec3Match (name string, bitmap []uint16) (dns.RR) {
+	hash := nsec3Hash(name)
+	return &dns.NSEC3{Hdr: z.denialHeader(strings.ToLower(hash) + "." + z.Name, dns.TypeNSEC3),
+			  Hash: dns.SHA1,
+			  HashLength: 20,
+			  NextDomain: shiftHash(hash, 1),
+			  TypeBitMap: bitmap}
+}
+
+func (z *ZoneSigner) nsec3Cover (name string) (dns.RR) {
+	// An NSEC3 record with a minimal range around the hash of `name`
+	hash := nsec3Hash(name)
+	return &dns.NSEC3{Hdr: z.denialHeader(strings.ToLower(shiftHash(hash, -1)) + "." + z.Name, dns.TypeNSEC3),
+			  Hash: dns.SHA1,
+			  HashLength: 20,
+			  NextDomain: shiftHash(hash, 1)}
+}
+
+func NSEC3PARAM (name string) (dns.RR) {
+	// We use no salt and no extra iterations, as recommended by RFC 9276
+	return &dns.NSEC3PARAM{Hdr: dns.RR_Header{Name: dns.CanonicalName(name), Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET},
+			       Hash: dns.SHA1}
+}
+
+func nsec3Hash (name string) (string) {
+	return dns.HashName(dns.CanonicalName(name), dns.SHA1, 0, "")
+}
+
+func shiftHash (hash string, delta int) (string) {
+	// Add `delta` (+1 or -1) to a base32hex encoded hash
+	raw, err := base32.HexEncoding.DecodeString(strings.ToUpper(hash))
+	if err != nil { return hash }
+
+	for i := len(raw) - 1; i >= 0; i-- {
+		old := raw[i]
+		raw[i] = byte(int(raw[i]) + delta)
+		// Stop unless we over- or underflowed and need to carry on
+		if (delta > 0 && raw[i] > old) || (delta < 0 && raw[i] < old) { break }
+	}
+
+	return base32.HexEncoding.EncodeToString(raw)
+}
+
+func prevName (name string) (string) {
+	// Returns a name which sorts shortly before `name` in canonical
+	// order (RFC 4034, 6.1). Decrement the last octet of the first label
+	// and pad it with \255 (RFC 4471, 3.1.2), so the range is tiny.
+	wire := make([]byte, 256)
+	end, err := dns.PackDomainName(dns.CanonicalName(name), wire, 0, nil, false)
+	if err != nil || end <= 1 { return name }
+
+	label := append([]byte{}, wire[1:1+wire[0]]...)
+	rest := wire[1+wire[0]:end]
+
+	last := label[len(label)-1]
+	if last == 0 {
+		// "a\000" is immediately preceded by "a"
+		label = label[:len(label)-1]
+	} else {
+		last--
+		// Uppercase sorts like lowercase, so skip past that range
+		if last >= 'A' && last <= 'Z' { last = 'A' - 1 }
+		label[len(label)-1] = last
+		for len(label) < 63 && len(label) + 1 + len(rest) < 255 {
+			label = append(label, 0xff)
+		}
+	}
+
+	var buf []byte
+	if len(label) > 0 { buf = append([]byte{byte(len(label))}, label...) }
+	buf = append(buf, rest...)
+
+	prev, _, err := dns.UnpackDomainName(buf, 0)
+	if err != nil { return name }
+	return prev
+}
+
+func nameExists (dnsdata map[string]map[uint16][]*DynRR, name string) (bool) {
+	// A name exists if it has data or is an empty non-terminal
+	if len(dnsdata[name]) > 0 { return true }
+	for owner := range dnsdata {
+		if len(dnsdata[owner]) > 0 && dns.IsSubDomain(name, owner) { return true }
+	}
+	return false
+}
+
+func closestEncloser (dnsdata map[string]map[uint16][]*DynRR, apex string, qname string) (string, string) {
+	// Returns the closest existing ancestor of `qname` and the
+	// name one label below it (the "next closer name")
+	nextcloser := qname
+	for qname != apex {
+		next, end := dns.NextLabel(qname, 0)
+		if end { break }
+		nextcloser, qname = qname, qname[next:]
+		if nameExists(dnsdata, qname) { break }
+	}
+	return qname, nextcloser
+}
+
+func typeBitmap (dnsdata map[string]map[uint16][]*DynRR, name string, nsec3 bool) ([]uint16) {
+	bitmap := []uint16{dns.TypeRRSIG}
+	if !nsec3 { bitmap = append(bitmap, dns.TypeNSEC) }
+	for qtype, records := range dnsdata[name] {
+		if len(records) > 0 { bitmap = append(bitmap, qtype) }
+	}
+	sort.Slice(bitmap, func(i, j int) bool { return bitmap[i] < bitmap[j] })
+	return bitmap
+}
+
+func appendUnique (rrs []dns.RR, rr dns.RR) ([]dns.RR) {
+	for _, existing := range rrs {
+		if dns.IsDuplicate(existing, rr) { return rrs }
+	}
+	return append(rrs, rr)
+}
+
+func rrsetFingerprint (rrset []dns.RR) (string) {
+	var parts []string
+	for _, rr := range rrset { parts = append(parts, rr.String()) }
+	sort.Strings(parts)
+	return strings.Join(parts, "\n")
+}
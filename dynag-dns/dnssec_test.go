@@ -0,0 +1,229 @@
+package main
+
+import "bytes"
+import "crypto"
+import "encoding/base32"
+import "strings"
+import "testing"
+import "time"
+import "github.com/miekg/dns"
+
+func testKeys (t *testing.T, name string) (DNSSECconf) {
+	// A ZSK and a KSK for `name`, generated for every test
+	var keys DNSSECconf
+	for _, flags := range []uint16{256, 257} {
+		dnskey := &dns.DNSKEY{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+				      Flags: flags, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+		privkey, err := dnskey.Generate(256)
+		if err != nil { t.Fatal(err) }
+		if flags == 256 {
+			keys.ZSK.DnsKey, keys.ZSK.Signer = dnskey, privkey.(crypto.Signer)
+		} else {
+			keys.KSK.DnsKey, keys.KSK.Signer = dnskey, privkey.(crypto.Signer)
+		}
+	}
+	keys.Enabled = true
+	return keys
+}
+
+func testZone (t *testing.T, nsec3 bool) (*ZoneSigner, map[string]map[uint16][]*DynRR) {
+	// example.org with its keys, www and a.b (so b is an empty non-terminal)
+	dnsdata := make(map[string]map[uint16][]*DynRR)
+	for _, text := range []string{"example.org. 60 IN SOA ns1.example.org. hostmaster.example.org. 1 3600 600 86400 60",
+				      "www.example.org. 60 IN A 192.0.2.1",
+				      "a.b.example.org. 60 IN TXT \"a\""} {
+		rr, err := dns.NewRR(text)
+		if err != nil { t.Fatal(err) }
+		AddStaticRecord(dnsdata, rr)
+	}
+
+	signer := EnableDNSSEC(dnsdata, make(map[string]*ZoneSigner), "example.org.", testKeys(t, "example.org."), nsec3)
+	return signer, dnsdata
+}
+
+func verifySigned (t *testing.T, signer *ZoneSigner, section []dns.RR) ([]dns.RR) {
+	// Checks every RRSIG in `section` against the published keys and
+	// returns the signed records
+	var records []dns.RR
+	var rrset []dns.RR
+	for _, rr := range section {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			records = append(records, rr)
+			rrset = append(rrset, rr)
+			continue
+		}
+		if len(rrset) == 0 { t.Fatalf("RRSIG without RRset: %s", sig) }
+
+		var dnskey *dns.DNSKEY
+		for _, key := range []*dns.DNSKEY{signer.Keys.ZSK.DnsKey, signer.Keys.KSK.DnsKey} {
+			if key.KeyTag() == sig.KeyTag { dnskey = key }
+		}
+		if dnskey == nil { t.Fatalf("No published key for %s", sig) }
+		if err := sig.Verify(dnskey, rrset); err != nil { t.Fatalf("Invalid signature %s: %s", sig, err) }
+		if !sig.ValidityPeriod(time.Now()) { t.Fatalf("Signature is not valid now: %s", sig) }
+		rrset = nil
+	}
+	if len(rrset) > 0 { t.Fatalf("Unsigned RRset: %v", rrset) }
+	return records
+}
+
+func canonicalLabels (t *testing.T, name string) ([][]byte) {
+	// The labels of `name` from the right, lowercased (RFC 4034, 6.1)
+	wire := make([]byte, 256)
+	end, err := dns.PackDomainName(dns.CanonicalName(name), wire, 0, nil, false)
+	if err != nil { t.Fatalf("Invalid name %q: %s", name, err) }
+
+	var labels [][]byte
+	for offset := 0; offset < end && wire[offset] > 0; offset += 1 + int(wire[offset]) {
+		labels = append([][]byte{bytes.ToLower(wire[offset+1:offset+1+int(wire[offset])])}, labels...)
+	}
+	return labels
+}
+
+func canonicalCompare (t *testing.T, a string, b string) (int) {
+	labelsA, labelsB := canonicalLabels(t, a), canonicalLabels(t, b)
+	for i := 0; i < len(labelsA) && i < len(labelsB); i++ {
+		if result := bytes.Compare(labelsA[i], labelsB[i]); result != 0 { return result }
+	}
+	return len(labelsA) - len(labelsB)
+}
+
+func nsecCovers (t *testing.T, nsec *dns.NSEC, name string) (bool) {
+	return canonicalCompare(t, nsec.Hdr.Name, name) < 0 && canonicalCompare(t, name, nsec.NextDomain) < 0
+}
+
+func nsec3Covers (nsec3 *dns.NSEC3, name string) (bool) {
+	// The synthesized ranges never wrap around the end of the hash space
+	owner := strings.ToUpper(strings.SplitN(nsec3.Hdr.Name, ".", 2)[0])
+	hash := nsec3Hash(name)
+	return owner < hash && hash < nsec3.NextDomain
+}
+
+func TestSignSection (t *testing.T) {
+	// Every RRset gets a signature which validates with the published keys
+	signer, dnsdata := testZone(t, false)
+	var section []dns.RR
+	for _, qtype := range []uint16{dns.TypeSOA, dns.TypeDNSKEY} {
+		for _, record := range dnsdata["example.org."][qtype] { section = append(section, record.Data) }
+	}
+	section = append(section, dnsdata["www.example.org."][dns.TypeA][0].Data)
+
+	signed := signer.SignSection(section)
+	if len(signed) != len(section) + 3 { t.Fatalf("Expected 3 signatures, got %v", signed) }
+	verifySigned(t, signer, signed)
+
+	// The DNSKEY set is signed by the KSK
+	for _, rr := range signed {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeDNSKEY && sig.KeyTag != signer.Keys.KSK.DnsKey.KeyTag() {
+			t.Errorf("DNSKEY set not signed by the KSK: %s", sig)
+		}
+	}
+}
+
+func TestDenialNSEC (t *testing.T) {
+	signer, dnsdata := testZone(t, false)
+	existing := []string{"example.org.", "www.example.org.", "b.example.org.", "a.b.example.org."}
+
+	for qname, wildcard := range map[string]string{"nx.example.org.": "*.example.org.",
+						      "x.y.b.example.org.": "*.b.example.org.",
+						      "WWX.example.org.": "*.example.org.",
+						      "a\\000.example.org.": "*.example.org."} {
+		var covered, wildcardCovered bool
+		for _, rr := range verifySigned(t, signer, signer.Denial(dnsdata, qname, true)) {
+			nsec := rr.(*dns.NSEC)
+			if nsecCovers(t, nsec, qname) { covered = true }
+			if nsecCovers(t, nsec, wildcard) { wildcardCovered = true }
+			for _, name := range existing {
+				if nsecCovers(t, nsec, name) { t.Errorf("%s covers existing name %s", nsec, name) }
+			}
+		}
+		if !covered { t.Errorf("No NSEC covers %s", qname) }
+		if !wildcardCovered { t.Errorf("No NSEC covers %s for %s", wildcard, qname) }
+	}
+
+	// NODATA: the NSEC at the name lists the existing types only
+	denial := verifySigned(t, signer, signer.Denial(dnsdata, "www.example.org.", false))
+	if len(denial) != 1 { t.Fatalf("Expected one NSEC, got %v", denial) }
+	nsec := denial[0].(*dns.NSEC)
+	if nsec.Hdr.Name != "www.example.org." { t.Errorf("NSEC for %s at %s", "www.example.org.", nsec.Hdr.Name) }
+	if len(nsec.TypeBitMap) != 3 || nsec.TypeBitMap[0] != dns.TypeA { t.Errorf("Unexpected types %v", nsec.TypeBitMap) }
+}
+
+func TestDenialNSEC3 (t *testing.T) {
+	signer, dnsdata := testZone(t, true)
+	existing := []string{"example.org.", "www.example.org.", "b.example.org.", "a.b.example.org."}
+
+	for _, test := range []struct { qname, closest, nextcloser string }{
+		{"nx.example.org.", "example.org.", "nx.example.org."},
+		{"x.y.b.example.org.", "b.example.org.", "y.b.example.org."},
+	} {
+		qname, closest, nextcloser := test.qname, test.closest, test.nextcloser
+		var matched, covered, wildcardCovered bool
+		for _, rr := range verifySigned(t, signer, signer.Denial(dnsdata, qname, true)) {
+			nsec3 := rr.(*dns.NSEC3)
+			if nsec3.Match(closest) { matched = true }
+			if nsec3Covers(nsec3, nextcloser) { covered = true }
+			if nsec3Covers(nsec3, "*." + closest) { wildcardCovered = true }
+			for _, name := range existing {
+				if nsec3Covers(nsec3, name) { t.Errorf("%s covers existing name %s", nsec3, name) }
+			}
+		}
+		if !matched { t.Errorf("No NSEC3 matches %s for %s", closest, qname) }
+		if !covered { t.Errorf("No NSEC3 covers %s for %s", nextcloser, qname) }
+		if !wildcardCovered { t.Errorf("No NSEC3 covers *.%s for %s", closest, qname) }
+	}
+}
+
+func TestPrevName (t *testing.T) {
+	long := strings.Repeat("a", 63)
+	expected := map[string]string{
+		// Dropping the trailing \000 gives the immediate predecessor
+		"a\\000.example.org.": "a.example.org.",
+		"\\000.example.org.": "example.org.",
+		// '[' follows 'Z', which sorts as 'z', so the label drops to '@'
+		"[.example.org.": "\\@" + strings.Repeat("\\255", 62) + ".example.org.",
+		// A full label is not padded
+		long + ".example.org.": long[:62] + "`.example.org.",
+		"b.example.org.": "a" + strings.Repeat("\\255", 62) + ".example.org.",
+	}
+
+	for name, prev := range expected {
+		result := prevName(name)
+		if result != prev { t.Errorf("prevName(%s) = %s, expected %s", name, result, prev) }
+		if canonicalCompare(t, result, name) >= 0 { t.Errorf("prevName(%s) = %s does not sort before it", name, result) }
+	}
+
+	// Padding keeps the name within 255 octets
+	deep := strings.Repeat(long[:50] + ".", 4) + "b.org."
+	if result := prevName(deep); canonicalCompare(t, result, deep) >= 0 { t.Errorf("prevName(%s) = %s", deep, result) }
+}
+
+func TestShiftHash (t *testing.T) {
+	encode := func(raw ...byte) (string) { return base32.HexEncoding.EncodeToString(append(make([]byte, 20 - len(raw)), raw...)) }
+
+	for _, test := range []struct { hash string; delta int; expected string }{
+		{encode(1), 1, encode(2)},
+		{encode(0, 0xff), 1, encode(1, 0)},
+		{encode(1, 0), -1, encode(0, 0xff)},
+		{strings.ToLower(encode(7)), -1, encode(6)},
+	} {
+		if result := shiftHash(test.hash, test.delta); result != test.expected {
+			t.Errorf("shiftHash(%s, %d) = %s, expected %s", test.hash, test.delta, result, test.expected)
+		}
+	}
+}
+
+func TestClosestEncloser (t *testing.T) {
+	_, dnsdata := testZone(t, false)
+	for _, test := range []struct { qname, closest, nextcloser string }{
+		{"nx.example.org.", "example.org.", "nx.example.org."},
+		{"x.y.b.example.org.", "b.example.org.", "y.b.example.org."},
+		{"x.a.b.example.org.", "a.b.example.org.", "x.a.b.example.org."},
+	} {
+		closest, nextcloser := closestEncloser(dnsdata, "example.org.", test.qname)
+		if closest != test.closest || nextcloser != test.nextcloser {
+			t.Errorf("closestEncloser(%s) = %s, %s, expected %s, %s", test.qname, closest, nextcloser, test.closest, test.nextcloser)
+		}
+	}
+}
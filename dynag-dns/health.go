@@ -0,0 +1,93 @@
+package main
+
+import "fmt"
+import "log"
+import "math"
+import "time"
+import config "github.com/olebedev/config"
+
+type Damping struct {
+	// Penalty added for each status change, which halves every
+	// `HalfLife`. A record whose penalty is above `Suppress` is not
+	// enabled again until the penalty decayed below `Reuse`.
+	HalfLife	time.Duration
+	Penalty		float64
+	Suppress	float64
+	Reuse		float64
+}
+
+func LoadDamping (cfg *config.Config) (*Damping) {
+	// Flap damping is off unless a `damping` section exists
+	damping, err := cfg.Get("damping")
+	if err != nil { return nil }
+
+	return &Damping{HalfLife: seconds(damping.UInt("halflife", 900)),
+			Penalty: damping.UFloat64("penalty", 1000),
+			Suppress: damping.UFloat64("suppress", 2500),
+			Reuse: damping.UFloat64("reuse", 750)}
+}
+
+func (record *DynRR) CurrentPenalty (now time.Time) (float64) {
+	// The penalty was stored at the last change and decays since then
+	if record.Damping == nil || record.Penalty == 0 { return 0 }
+	elapsed := now.Sub(record.LastChange).Seconds()
+	return record.Penalty * math.Pow(0.5, elapsed / record.Damping.HalfLife.Seconds())
+}
+
+func (record *DynRR) Apply (success bool, now time.Time) (bool) {
+	// Count the check result and return true if the record changes its
+	// status. This happens after `Rise` successes or `Fall` failures
+	// in a row, or with the very first result for this record.
+	if success {
+		record.Successes++
+		record.Failures = 0
+	} else {
+		record.Failures++
+		record.Successes = 0
+	}
+
+	// Nothing changes, but the first result still establishes the status
+	if record.Enabled == success {
+		if record.LastChange.IsZero() { record.LastChange = now }
+		return false
+	}
+
+	// Not enough results in a row yet
+	if !record.LastChange.IsZero() {
+		if success && record.Successes < record.Rise { return false }
+		if !success && record.Failures < record.Fall { return false }
+	}
+
+	penalty := record.CurrentPenalty(now)
+
+	// Hold back flapping records until they are stable again
+	if success && record.Damping != nil {
+		if record.Suppressed && penalty < record.Damping.Reuse {
+			log.Printf("Flap damping released %s\n", record.Data.String())
+			record.Suppressed = false
+		}
+		if !record.Suppressed && penalty >= record.Damping.Suppress {
+			log.Printf("Flap damping suppresses %s\n", record.Data.String())
+			record.Suppressed = true
+		}
+		if record.Suppressed { return false }
+	}
+
+	if record.Damping != nil && !record.LastChange.IsZero() {
+		record.Penalty = penalty + record.Damping.Penalty
+	}
+
+	record.Enabled = success
+	record.LastChange = now
+	return true
+}
+
+func (record *DynRR) Counters () (string) {
+	// Summary of the counters for log messages
+	counters := fmt.Sprintf("rise %d/%d, fall %d/%d", record.Successes, record.Rise, record.Failures, record.Fall)
+	if record.Damping != nil {
+		counters += fmt.Sprintf(", penalty %.0f", record.CurrentPenalty(time.Now()))
+		if record.Suppressed { counters += ", suppressed" }
+	}
+	return counters
+}
@@ -0,0 +1,113 @@
+package main
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "log"
+import "net/http"
+import "strconv"
+import "time"
+import config "github.com/olebedev/config"
+
+// Number of pending notifications, more are dropped
+const hookQueueSize = 100
+
+type StateChange struct {
+	// Sent to hooks for every status change of a record
+	Record		string		`json:"record"`
+	Name		string		`json:"name"`
+	Type		string		`json:"type"`
+	OldState	string		`json:"old_state"`
+	NewState	string		`json:"new_state"`
+	Output		string		`json:"output"`
+	Served		int		`json:"served"`
+	Time		time.Time	`json:"time"`
+}
+
+type Hooks struct {
+	// A command and/or webhook which are told about status changes.
+	// They run one after another in the background, so a slow hook
+	// never holds up DNS answers.
+	Command		[]string
+	Webhook		string
+	Timeout		time.Duration
+	queue		chan StateChange
+}
+
+func LoadHooks (cfg *config.Config) (*Hooks, error) {
+	// Reads the `hooks` section, which is optional
+	hookconf, err := cfg.Get("hooks")
+	if err != nil { return nil, nil }
+
+	h := &Hooks{Webhook: hookconf.UString("webhook"),
+		    Timeout: seconds(hookconf.UInt("timeout", 10))}
+
+	if command := hookconf.UString("command"); command != "" {
+		h.Command, err = SplitCommand(command)
+		if err != nil { return nil, err }
+	}
+	if len(h.Command) == 0 && h.Webhook == "" { return nil, errors.New("Neither command nor webhook defined for hooks") }
+
+	return h, nil
+}
+
+func (h *Hooks) Start () {
+	h.queue = make(chan StateChange, hookQueueSize)
+	go h.run(h.queue)
+}
+
+func (h *Hooks) Stop () {
+	// Pending notifications are still delivered
+	close(h.queue)
+}
+
+func (h *Hooks) Fire (change StateChange) {
+	// Called with the record store locked, so this must not block
+	select {
+	case h.queue <- change:
+	default:
+		log.Printf("Hook queue is full, dropping notification for %s\n", change.Record)
+	}
+}
+
+func (h *Hooks) run (queue chan StateChange) {
+	for change := range queue {
+		if len(h.Command) > 0 { h.exec(change) }
+		if h.Webhook != "" { h.post(change) }
+	}
+}
+
+func (h *Hooks) exec (change StateChange) {
+	// The details are passed in the environment and as JSON on stdin
+	env := []string{"DYNAG_RECORD=" + change.Record,
+			"DYNAG_NAME=" + change.Name,
+			"DYNAG_TYPE=" + change.Type,
+			"DYNAG_OLD_STATE=" + change.OldState,
+			"DYNAG_NEW_STATE=" + change.NewState,
+			"DYNAG_OUTPUT=" + change.Output,
+			"DYNAG_SERVED=" + strconv.Itoa(change.Served),
+			"DYNAG_TIME=" + change.Time.Format(time.RFC3339)}
+	payload, _ := json.Marshal(change)
+
+	_, rcode, err := sysexec(h.Command[0], h.Command[1:], payload, env, h.Timeout)
+	if err == nil && rcode != 0 { err = fmt.Errorf("Exit code %d", rcode) }
+	if err != nil { log.Printf("Hook command for %s failed: %s\n", change.Record, err) }
+}
+
+func (h *Hooks) post (change StateChange) {
+	payload, _ := json.Marshal(change)
+
+	client := &http.Client{Timeout: h.Timeout}
+	response, err := client.Post(h.Webhook, "application/json", bytes.NewReader(payload))
+	if err == nil {
+		response.Body.Close()
+		if response.StatusCode >= 300 { err = errors.New(response.Status) }
+	}
+	if err != nil { log.Printf("Webhook for %s failed: %s\n", change.Record, err) }
+}
+
+func StateName (enabled bool) (string) {
+	if enabled { return "up" }
+	return "down"
+}
@@ -1,11 +1,10 @@
 package main
 
-import "bytes"
 import "crypto"
 import "errors"
+import "fmt"
 import "log"
 import "os"
-import "os/exec"
 import "strconv"
 import "strings"
 import "time"
@@ -15,8 +14,10 @@ import "github.com/whiteShtef/clockwork"
 import config "github.com/olebedev/config"
 
 type checkResult struct {
-	Uuid	string
-	Success	bool
+	Uuid		string
+	Success		bool
+	Output		string
+	Duration	time.Duration
 }
 
 type DynRR struct {
@@ -25,6 +26,23 @@ type DynRR struct {
 	Uuid		string
 	LastChange	time.Time
 	DNSSEC		DNSSECconf
+	Rise		int
+	Fall		int
+	Successes	int
+	Failures	int
+	Damping		*Damping
+	Penalty		float64
+	Suppressed	bool
+	Tier		int
+	FailOpen	bool
+	LastCheck	time.Time
+	LastOutput	string
+	Latency		time.Duration
+	Override	*Override
+	Definition	string
+	Stale		bool
+	Dynamic		bool
+	Weight		int
 }
 
 type DNSSECconf	struct {
@@ -39,21 +57,22 @@ type DNSSECconf	struct {
 	}
 }
 
+type LoadedConfig struct {
+	// Everything built from the configuration file
+	Data		map[string]map[uint16][]*DynRR
+	Checks		[]*Check
+	Zone		*Zone
+	Signers		map[string]*ZoneSigner
+	Hooks		*Hooks
+	Update		*UpdateConf
+	Answers		AnswerConf
+}
+
 var resultChan chan checkResult
-var DNSrequests chan *dns.Msg
-var DNSresponses chan *dns.Msg
 
 func main() {
 	// Initialize channels
         resultChan = make(chan checkResult, 20)
-	DNSrequests = make(chan *dns.Msg, 20)
-	DNSresponses = make(chan *dns.Msg, 20)
-
-	// Initialize DNS data structure
-	dnsdata := make(map[string]map[uint16][]*DynRR)
-	// First level is `qname`, e.g. www.example.org.
-	// Second level is `qtype`, e.g. 1 for A or 28 for AAAA
-	// Last level is an array of records under this name and type
 
 	// Default config is `config.json` in pwd
 	configpath := "./config.json"
@@ -67,74 +86,76 @@ func main() {
 		log.Fatal(conferr)
 	}
 
-	// Set up the scheduler
-	sched := clockwork.NewScheduler()
-
-	// Iterate over names in configuration
-	for i := 0; i < len(cfg.UList("names")); i++ {
-		uuid := GenerateUUID()
-		nameconf, _ := cfg.Get("names." + strconv.Itoa(i))
-		newrr, _ := dns.NewRR(nameconf.UString("name") + " " + nameconf.UString("rr"))
-		header := newrr.Header()
-
-		// Init DNSSEC, if configured
-		var dscfg DNSSECconf
-		if nameconf.UBool("dnssec.enabled") {
-			log.Printf("Configuring DNSSEC for %s\n", header.Name)
-
-			log.Printf("Loading ZSK for %s\n", header.Name)
-			zskrr, zsksigner, zskerr := LoadKeyPair(nameconf.UString("dnssec.zsk.private"), nameconf.UString("dnssec.zsk.key"))
-			if zskerr == nil && zskrr.Flags == 256 {
-				dscfg.ZSK.DnsKey = zskrr
-				dscfg.ZSK.Signer = zsksigner
-			} else {
-				if zskerr != nil { log.Printf("Failed to load ZSK for %s: %s\n", header.Name, zskerr) }
-				if zskrr.Flags != 256 {
-					log.Printf("Failed to load ZSK for %s: Flag is %d, should be 256\n", header.Name, zskrr.Flags)
-					zskerr = errors.New("Incorrect Flags for ZSK")
-				}
-			}
+	// Records added with UPDATE are part of the data
+	if dynerr := LoadDynamic(cfg.UString("update.file")); dynerr != nil {
+		log.Fatal(dynerr)
+	}
 
-			log.Printf("Loading KSK for %s\n", header.Name)
-			kskrr, ksksigner, kskerr := LoadKeyPair(nameconf.UString("dnssec.ksk.private"), nameconf.UString("dnssec.ksk.key"))
-			if kskerr == nil && kskrr.Flags == 257 {
-				dscfg.KSK.DnsKey = kskrr
-				dscfg.KSK.Signer = ksksigner
-			} else {
-				if kskerr != nil { log.Printf("Failed to load KSK for %s: %s\n", header.Name, kskerr) }
-				if kskrr.Flags != 257 {
-					log.Printf("Failed to load KSK for %s: Flag is %d, should be 257\n", header.Name, kskrr.Flags)
-					kskerr = errors.New("Incorrect Flags for KSK")
-				}
-			}
+	// Build records, health checks, zone and signers
+	loaded, loaderr := LoadData(cfg)
+	if loaderr != nil {
+		log.Fatal(loaderr)
+	}
+	runningConfig = cfg
+	loaded.Update.Activate()
+	zone = loaded.Zone
+	signers = loaded.Signers
+	if zone != nil { log.Printf("Serving zone %s with serial %d\n", zone.Name, zone.Serial()) }
+
+	// DNS queries are answered directly from the store,
+	// check results are processed in the background
+	store = NewRecordStore(loaded.Data)
+	store.Hooks = loaded.Hooks
+	store.Answers = loaded.Answers
+	if store.Hooks != nil { store.Hooks.Start() }
+	go store.ProcessResults(resultChan)
+	RegisterMetrics(store)
+
+	// Metrics are also available from the admin interface
+	if metricsconf, metricserr := cfg.Get("metrics"); metricserr == nil {
+		go ServeMetrics(metricsconf.UString("listen", "127.0.0.1:9153"))
+	}
 
-			if zskerr == nil && kskerr == nil {
-				log.Printf("Activating DNSSEC for %s\n", header.Name)
-				dscfg.Enabled = true
-			}
+	// Restore overrides and start the admin interface, if configured
+	if adminconf, adminerr := cfg.Get("admin"); adminerr == nil {
+		store.OverrideFile = adminconf.UString("overrides")
+		if loaderr := store.LoadOverrides(); loaderr != nil {
+			log.Printf("Failed to load overrides from %s: %s\n", store.OverrideFile, loaderr)
 		}
 
-		// Add name to the DNS data structure
-		dnsdata[header.Name] = make(map[uint16][]*DynRR)
-		dnsdata[header.Name][header.Rrtype] = append(dnsdata[header.Name][header.Rrtype],
-		&DynRR{Data: newrr, Enabled: false, Uuid: uuid, DNSSEC: dscfg} )
+		admin := &AdminServer{Store: store, Token: adminconf.UString("token")}
+		go admin.ListenAndServe(adminconf.UString("listen", "127.0.0.1:8053"))
+	}
 
-		// Create Records for KSK and ZSK
-		if dscfg.Enabled {
-			dnsdata[header.Name][dns.TypeDNSKEY] = []*DynRR{ &DynRR{Data: dscfg.KSK.DnsKey, Enabled: true },
-									 &DynRR{Data: dscfg.ZSK.DnsKey, Enabled: true } }
+	// Restore the health state of the last run, if configured
+	if stateconf, stateerr := cfg.Get("state"); stateerr == nil {
+		store.StateFile = stateconf.UString("file")
+		serveStale = stateconf.UString("stale", "serve") == "serve"
+		if loaderr := store.LoadState(seconds(stateconf.UInt("maxage", 0))); loaderr != nil {
+			log.Printf("Failed to load state from %s: %s\n", store.StateFile, loaderr)
 		}
+		go SaveStateOnExit()
+	}
 
-		// Run initial check immediately to determine status
-		go func(){ run_check(nameconf.UString("command"), uuid) }()
+	// Run initial checks immediately to determine status
+	checks.Sync(loaded.Checks)
+	checks.RunDue()
 
-		// Schedule recurring checks for this entry
-		sched.Schedule().Every(nameconf.UInt("interval")).Seconds().Do(
-			func() { run_check(nameconf.UString("command"), uuid) })
+	// Set up the scheduler, which starts the checks when they are due
+	sched := clockwork.NewScheduler()
+	sched.Schedule().Every(1).Seconds().Do(checks.RunDue)
+
+	// Save the counters regularly, status changes are saved immediately
+	if store.StateFile != "" {
+		sched.Schedule().Every(cfg.UInt("state.interval", 10)).Seconds().Do(store.SaveState)
 	}
 
-	// Start the processing of check results and DNS queries
-	go processor(dnsdata)
+	// Reload the configuration on SIGHUP, or when the file changes
+	go ReloadOnSignal(configpath)
+	if cfg.UBool("watch") {
+		WatchConfig(configpath)
+		sched.Schedule().Every(5).Seconds().Do(func() { WatchConfig(configpath) })
+	}
 
 	// Run the previously configured scheduler
 	go sched.Run()
@@ -145,8 +166,8 @@ func main() {
 	// Set up the server objects
 	listenon := cfg.UString("server.listen","127.0.0.1") + ":" + cfg.UString("server.port","53")
 	log.Printf("Listening on %s", listenon)
-	udpserver := &dns.Server{Addr: listenon, Net: "udp"}
-	tcpserver := &dns.Server{Addr: listenon, Net: "tcp"}
+	udpserver := &dns.Server{Addr: listenon, Net: "udp", TsigProvider: keyring, MsgAcceptFunc: AcceptMessage}
+	tcpserver := &dns.Server{Addr: listenon, Net: "tcp", TsigProvider: keyring, MsgAcceptFunc: AcceptMessage}
 
 	// Start listeners
 	go func(){ _ = udpserver.ListenAndServe() }()
@@ -156,116 +177,143 @@ func main() {
 	select {}
 }
 
-func run_check (command string, uuid string) {
-	// Split the command into it's first bit (the binary) and the rest (the arguments)
-	comsplit := strings.Split(command, ` `)
+func LoadData (cfg *config.Config) (*LoadedConfig, error) {
+	// Builds everything we serve from `cfg`, without touching
+	// the running state, so it can be used for reloads
+	loaded := &LoadedConfig{Signers: make(map[string]*ZoneSigner)}
 
-	// Call the sysexec function to run the check (nil == no input to the called binary)
-	_, rcode, _ := sysexec(comsplit[0], comsplit[1:], nil)
+	// Hooks for status changes
+	var hookerr error
+	loaded.Hooks, hookerr = LoadHooks(cfg)
+	if hookerr != nil { return nil, hookerr }
 
-	// Put the return code of the check into the results channel
-	resultChan <- checkResult{Uuid: uuid, Success: rcode == 0}
-}
+	// Keys for UPDATE
+	var updateerr error
+	loaded.Update, updateerr = LoadUpdateConf(cfg)
+	if updateerr != nil { return nil, updateerr }
 
-func sysexec (command string, args []string, input []byte) ([]byte, int, error) {
-        var output bytes.Buffer
+	// Order and number of records in responses
+	var answerserr error
+	loaded.Answers, answerserr = LoadAnswerConf(cfg)
+	if answerserr != nil { return nil, answerserr }
 
-        cmd := exec.Command(command, args...)
-        cmd.Stdin = bytes.NewBuffer(input)
-        cmd.Stdout = &output
-        err := cmd.Run()
-
-        exitcode := 0
-        if exitError, ok := err.(*exec.ExitError); ok {
-                exitcode = exitError.ExitCode()
-        }
-
-        return output.Bytes(), exitcode, err
-}
+	// Initialize DNS data structure
+	dnsdata := make(map[string]map[uint16][]*DynRR)
+	// First level is `qname`, e.g. www.example.org.
+	// Second level is `qtype`, e.g. 1 for A or 28 for AAAA
+	// Last level is an array of records under this name and type
+	loaded.Data = dnsdata
 
-func processor (dnsdata map[string]map[uint16][]*DynRR) {
-	go func() {
-	// Process check results
-	for check := range resultChan {
-		// Find the record this check result applies to
-		// Inefficient, but this is a proof of concept
-		for qname := range dnsdata {
-			for qtype := range dnsdata[qname] {
-				for _, record := range dnsdata[qname][qtype] {
-					if record.Uuid == check.Uuid && record.Enabled != check.Success {
-						// Change the boolean status, log it, and set a timestamp (for debugging)
-						log.Printf("Status change for %s to %s\n",
-						record.Data.String(),
-						UpBool(check.Success))
-
-						record.Enabled = check.Success
-						record.LastChange = time.Now()
-					}
-				}
-			}
-		}
+	// Names in the configuration, followed by those added with UPDATE
+	var entries []*config.Config
+	for i := 0; i < len(cfg.UList("names")); i++ {
+		nameconf, _ := cfg.Get("names." + strconv.Itoa(i))
+		entries = append(entries, nameconf)
 	}
-	}()
-
-	go func() {
-	// Process DNS queries
-	for query := range DNSrequests {
-		// Setup an answer object
-		answer := new(dns.Msg)
-		answer.MsgHdr.Authoritative = true
-		answer.Compress = false
-
-		// Handle non INET class (respond with NOTIMP)
-		if query.Question[0].Qclass != dns.ClassINET {
-			answer.SetRcode(query, dns.StringToRcode["NOTIMP"])
-			DNSresponses <- answer
-			continue
+	configured := len(entries)
+	entries = append(entries, dynamic.Entries(loaded.Update)...)
+
+	for i, nameconf := range entries {
+		name := dns.CanonicalName(nameconf.UString("name"))
+
+		// `rr` is a single record or a list of records, e.g. for A and AAAA
+		var rrlist []string
+		if list, listerr := nameconf.List("rr"); listerr == nil {
+			for _, text := range list { rrlist = append(rrlist, fmt.Sprint(text)) }
+		} else {
+			rrlist = append(rrlist, nameconf.UString("rr"))
 		}
 
-		// If this record is not in the map, we return NXDOMAIN
-		if len(dnsdata[query.Question[0].Name]) == 0 {
-			answer.SetRcode(query, dns.StringToRcode["NXDOMAIN"])
-			DNSresponses <- answer
-			continue
+		// Init DNSSEC, if configured
+		var dscfg DNSSECconf
+		if nameconf.UBool("dnssec.enabled") {
+			dscfg = LoadDNSSECconf(nameconf, name)
 		}
 
-		// If no record for this type exists, we should return empty NOERROR
-		if len(dnsdata[query.Question[0].Name][query.Question[0].Qtype]) == 0 {
-			answer.SetRcode(query, dns.StringToRcode["NOERROR"])
-			DNSresponses <- answer
-			continue
+		// Create Records for KSK and ZSK and set up online signing
+		if dscfg.Enabled {
+			EnableDNSSEC(dnsdata, loaded.Signers, name, dscfg, nameconf.UBool("dnssec.nsec3"))
 		}
 
-		// We need to check if at least one record is `Enabled`
-		// If there is none, return SERVFAIL, to prevent caching
-		enabled := 0
-		for _, record := range dnsdata[query.Question[0].Name][query.Question[0].Qtype] {
-			if record.Enabled { enabled++ }
+		// Set up the health check for this entry. Entries
+		// without `check` and `command` are always enabled.
+		var probe Probe
+		_, checkerr := nameconf.Get("check")
+		if checkerr == nil || nameconf.UString("command") != "" {
+			var probeerr error
+			probe, probeerr = NewProbe(nameconf)
+			if probeerr != nil {
+				return nil, fmt.Errorf("Invalid check for %s: %s", name, probeerr)
+			}
 		}
 
-		if enabled == 0 {
-			answer.SetRcode(query, dns.StringToRcode["SERVFAIL"])
-			DNSresponses <- answer
-			continue
-		}
+		interval := nameconf.UInt("interval")
+		if interval < 1 { interval = 1 }
+		weight := nameconf.UInt("weight", 1)
+		if weight < 0 { return nil, fmt.Errorf("Invalid weight for %s: %d", name, weight) }
+
+		for _, text := range rrlist {
+			newrr, rrerr := dns.NewRR(name + " " + text)
+			if rrerr != nil || newrr == nil {
+				return nil, fmt.Errorf("Invalid record for %s: %v", name, rrerr)
+			}
 
-		// At this point, data should be available, so we construct a proper answer
-		answer.SetReply(query)
-		for _, record := range dnsdata[query.Question[0].Name][query.Question[0].Qtype] {
-			if record.Enabled {
-				answer.Answer = append(answer.Answer, record.Data)
+			if probe == nil {
+				static := AddStaticRecord(dnsdata, newrr)
+				static.Dynamic = i >= configured
+				static.Weight = weight
+				continue
 			}
+
+			// Add name to the DNS data structure (several entries may share a name),
+			// every record gets its own check
+			record := &DynRR{Data: newrr, Enabled: false, Uuid: GenerateUUID(), DNSSEC: dscfg,
+					 Definition: CheckDefinition(newrr, nameconf),
+					 Rise: nameconf.UInt("rise", 1), Fall: nameconf.UInt("fall", 1),
+					 Damping: LoadDamping(nameconf),
+					 Tier: nameconf.UInt("tier", 0), FailOpen: nameconf.UBool("failopen"),
+					 Dynamic: i >= configured, Weight: weight}
+			if dnsdata[name] == nil { dnsdata[name] = make(map[uint16][]*DynRR) }
+			dnsdata[name][newrr.Header().Rrtype] = append(dnsdata[name][newrr.Header().Rrtype], record)
+
+			loaded.Checks = append(loaded.Checks, &Check{Record: record, Probe: probe, Interval: seconds(interval)})
+		}
+	}
+
+	// Set up the zone apex, if configured
+	if zoneconf, zoneerr := cfg.Get("zone"); zoneerr == nil {
+		var records []dns.RR
+		loaded.Zone, records, zoneerr = LoadZone(zoneconf)
+		if zoneerr != nil {
+			return nil, zoneerr
 		}
 
-		if (DObit(query)) {
-			// According to IB, over 1220 weird things may happen
-			answer.SetEdns0(1220, true)
+		loaded.Zone.Record = AddStaticRecord(dnsdata, loaded.Zone.SOA)
+		for _, rr := range records {
+			AddStaticRecord(dnsdata, rr)
+		}
+
+		for qname := range dnsdata {
+			if !loaded.Zone.Contains(qname) { log.Printf("Warning: %s is outside of zone %s\n", qname, loaded.Zone.Name) }
 		}
 
-		// Send our compiled answer
-		DNSresponses <- answer
+		if zoneconf.UBool("dnssec.enabled") {
+			signer := EnableDNSSEC(dnsdata, loaded.Signers, loaded.Zone.Name,
+					       LoadDNSSECconf(zoneconf, loaded.Zone.Name), zoneconf.UBool("dnssec.nsec3"))
+			if signer != nil { signer.DenialTTL = loaded.Zone.NegativeSOA().Header().Ttl }
+		}
 	}
-	}()
+
+	WarnConflicts(dnsdata)
+
+	return loaded, nil
+}
+
+func run_check (probe Probe, uuid string) {
+	// Run the check and put its result into the results channel
+	start := time.Now()
+	success, output := probe.Check()
+	resultChan <- checkResult{Uuid: uuid, Success: success, Output: output, Duration: time.Since(start)}
 }
 
 func handleDnsRequest (w dns.ResponseWriter, r *dns.Msg) {
@@ -275,11 +323,49 @@ func handleDnsRequest (w dns.ResponseWriter, r *dns.Msg) {
 								     w.RemoteAddr(),
 								     DObit(r))
 
-	// Put the request into the DNSrequests channel
-	DNSrequests <- r
+	// Updates are handled separately (see Update)
+	if r.Opcode == dns.OpcodeUpdate {
+		handleUpdate(w, r)
+		return
+	}
+
+	// Zone transfers are only allowed for configured clients
+	qtype := r.Question[0].Qtype
+	if qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		zone := store.Zone()
+		if zone == nil || !zone.TransferAllowed(w.RemoteAddr()) ||
+		   (qtype == dns.TypeAXFR && w.RemoteAddr().Network() != "tcp") {
+			log.Printf("Refusing %s to %s\n", dns.TypeToString[qtype], w.RemoteAddr())
+			refused := new(dns.Msg)
+			refused.SetRcode(r, dns.RcodeRefused)
+			store.CountQuery(r, refused)
+			werr := w.WriteMsg(refused)
+			if werr != nil { log.Println(werr) }
+			return
+		}
+	}
+
+	// Build the answer for this request
+	response := store.Answer(r)
+	store.CountQuery(r, response)
 
-	// Write the latest response from the DNSresponses channel to the network
-	werr := w.WriteMsg(<-DNSresponses)
+	// Transfers are sent as a series of messages over TCP
+	if (qtype == dns.TypeAXFR || qtype == dns.TypeIXFR) && response.Rcode == dns.RcodeSuccess {
+		if w.RemoteAddr().Network() == "tcp" {
+			terr := TransferOut(w, r, response)
+			if terr != nil { log.Println(terr) }
+			return
+		}
+
+		// IXFR over UDP: if it's more than the SOA, ask the client to use TCP (RFC 1995, 2)
+		if len(response.Answer) > 1 { response.Answer = response.Answer[:1] }
+	}
+
+	// Large answers don't fit into UDP, the client has to use TCP
+	if w.RemoteAddr().Network() == "udp" { Truncate(response, udpSize(r)) }
+
+	// Write the response to the network
+	werr := w.WriteMsg(response)
 	if werr != nil {
 		log.Println(werr)
 	}
@@ -299,9 +385,111 @@ func DObit (query *dns.Msg) (bool) {
 	// Check if the query has the DO (DNSSEC OK) flag set
 	// If yes, the answer should contain RRSIGs, if applicable
 	opt := query.IsEdns0()
+	if opt == nil { return false }
 	return opt.Do()
 }
 
+func AddStaticRecord (dnsdata map[string]map[uint16][]*DynRR, rr dns.RR) (*DynRR) {
+	// Records without a health check are always enabled
+	header := rr.Header()
+	header.Name = dns.CanonicalName(header.Name)
+	record := &DynRR{Data: rr, Enabled: true, Weight: 1}
+	if dnsdata[header.Name] == nil { dnsdata[header.Name] = make(map[uint16][]*DynRR) }
+	dnsdata[header.Name][header.Rrtype] = append(dnsdata[header.Name][header.Rrtype], record)
+	return record
+}
+
+func EnableDNSSEC (dnsdata map[string]map[uint16][]*DynRR, keyring map[string]*ZoneSigner, name string, dscfg DNSSECconf, nsec3 bool) (*ZoneSigner) {
+	// Publishes the keys of `name` and sets up online signing
+	if !dscfg.Enabled { return nil }
+
+	signer := NewZoneSigner(name, dscfg, nsec3)
+	AddStaticRecord(dnsdata, dscfg.KSK.DnsKey)
+	AddStaticRecord(dnsdata, dscfg.ZSK.DnsKey)
+	if signer.NSEC3 { AddStaticRecord(dnsdata, NSEC3PARAM(name)) }
+	keyring[signer.Name] = signer
+
+	return signer
+}
+
+func SignAnswer (query *dns.Msg, answer *dns.Msg, dnsdata map[string]map[uint16][]*DynRR) {
+	// Only resolvers which asked for DNSSEC get signatures
+	if !DObit(query) { return }
+
+	// According to IB, over 1220 weird things may happen
+	defer answer.SetEdns0(maxUDPSize, true)
+
+	signer := FindSigner(query.Question[0].Name)
+	if signer == nil { return }
+
+	// Records synthesized from wildcards differ for every qname,
+	// so their signatures are not cached
+	synthesized := false
+	for _, rr := range answer.Answer {
+		if len(dnsdata[rr.Header().Name]) == 0 { synthesized = true }
+	}
+
+	final, negative := negativeAnswer(answer, dnsdata)
+	answer.Answer = signer.signSection(answer.Answer, !synthesized)
+	answer.Ns = signer.SignSection(answer.Ns)
+	answer.Extra = signer.SignSection(answer.Extra)
+
+	if negative {
+		// No data, so we need to prove that with NSEC/NSEC3
+		// (for the target, if we followed a CNAME)
+		if finalsigner := FindSigner(final); finalsigner != nil {
+			answer.Ns = append(answer.Ns, finalsigner.Denial(dnsdata, final, answer.Rcode == dns.RcodeNameError)...)
+		}
+	}
+}
+
+func LoadDNSSECconf (cfg *config.Config, name string) (DNSSECconf) {
+	// Loads ZSK and KSK from the `dnssec` section of `cfg`
+	var dscfg DNSSECconf
+	log.Printf("Configuring DNSSEC for %s\n", name)
+
+	log.Printf("Loading ZSK for %s\n", name)
+	zskrr, zsksigner, zskerr := LoadKeyPair(cfg.UString("dnssec.zsk.private"), cfg.UString("dnssec.zsk.key"))
+	if zskerr == nil && dns.CanonicalName(zskrr.Hdr.Name) != dns.CanonicalName(name) {
+		// Signatures are made for `name`, so the key must be published there
+		zskerr = fmt.Errorf("Key is for %s, not %s", zskrr.Hdr.Name, name)
+	}
+	if zskerr == nil && zskrr.Flags == 256 {
+		dscfg.ZSK.DnsKey = zskrr
+		dscfg.ZSK.Signer = zsksigner
+	} else {
+		if zskerr != nil { log.Printf("Failed to load ZSK for %s: %s\n", name, zskerr) }
+		if zskrr != nil && zskrr.Flags != 256 {
+			log.Printf("Failed to load ZSK for %s: Flag is %d, should be 256\n", name, zskrr.Flags)
+			zskerr = errors.New("Incorrect Flags for ZSK")
+		}
+	}
+
+	log.Printf("Loading KSK for %s\n", name)
+	kskrr, ksksigner, kskerr := LoadKeyPair(cfg.UString("dnssec.ksk.private"), cfg.UString("dnssec.ksk.key"))
+	if kskerr == nil && dns.CanonicalName(kskrr.Hdr.Name) != dns.CanonicalName(name) {
+		// Signatures are made for `name`, so the key must be published there
+		kskerr = fmt.Errorf("Key is for %s, not %s", kskrr.Hdr.Name, name)
+	}
+	if kskerr == nil && kskrr.Flags == 257 {
+		dscfg.KSK.DnsKey = kskrr
+		dscfg.KSK.Signer = ksksigner
+	} else {
+		if kskerr != nil { log.Printf("Failed to load KSK for %s: %s\n", name, kskerr) }
+		if kskrr != nil && kskrr.Flags != 257 {
+			log.Printf("Failed to load KSK for %s: Flag is %d, should be 257\n", name, kskrr.Flags)
+			kskerr = errors.New("Incorrect Flags for KSK")
+		}
+	}
+
+	if zskerr == nil && kskerr == nil {
+		log.Printf("Activating DNSSEC for %s\n", name)
+		dscfg.Enabled = true
+	}
+
+	return dscfg
+}
+
 func LoadKeyPair (privfile string, pubfile string) (*dns.DNSKEY, crypto.Signer, error) {
 	if privfile == "" { return nil, nil, errors.New("No filename for private key") }
 	if pubfile == "" { return nil, nil, errors.New("No filename for public key") }
@@ -0,0 +1,150 @@
+package main
+
+import "log"
+import "net/http"
+import "time"
+import "github.com/miekg/dns"
+import "github.com/prometheus/client_golang/prometheus"
+import "github.com/prometheus/client_golang/prometheus/promhttp"
+
+// Queries for names we don't have are counted under this name,
+// so random names can't blow up the number of series
+const otherName = "_other"
+
+var queryCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "dynag_queries_total",
+	Help: "DNS queries answered, by name, type and rcode",
+}, []string{"qname", "qtype", "rcode"})
+
+var checkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "dynag_check_duration_seconds",
+	Help: "Duration of health checks",
+	Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+}, []string{"name", "type", "record"})
+
+var checkFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "dynag_check_failures_total",
+	Help: "Failed health checks",
+}, []string{"name", "type", "record"})
+
+var (
+	recordEnabledDesc = prometheus.NewDesc("dynag_record_enabled",
+		"Whether the last checks of a record succeeded (1) or not (0)",
+		[]string{"name", "type", "record"}, nil)
+	recordServedDesc = prometheus.NewDesc("dynag_record_served",
+		"Whether a record is currently served (1) or not (0)",
+		[]string{"name", "type", "record"}, nil)
+	recordChangeDesc = prometheus.NewDesc("dynag_record_last_change_timestamp_seconds",
+		"Time of the last status change of a record",
+		[]string{"name", "type", "record"}, nil)
+	poolRecordsDesc = prometheus.NewDesc("dynag_pool_records",
+		"Number of records for a name and type",
+		[]string{"name", "type"}, nil)
+	poolServedDesc = prometheus.NewDesc("dynag_pool_served_records",
+		"Number of records currently served for a name and type",
+		[]string{"name", "type"}, nil)
+)
+
+type storeCollector struct {
+	// Reports the status of all records in the store at scrape time,
+	// so records removed by a reload disappear from the metrics
+	Store		*RecordStore
+}
+
+func RegisterMetrics (s *RecordStore) {
+	prometheus.MustRegister(queryCounter, checkDuration, checkFailures, &storeCollector{Store: s})
+}
+
+func MetricsHandler () (http.Handler) {
+	return promhttp.Handler()
+}
+
+func ServeMetrics (listen string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+
+	log.Printf("Metrics listening on %s\n", listen)
+	log.Println(http.ListenAndServe(listen, mux))
+}
+
+func (c *storeCollector) Describe (ch chan<- *prometheus.Desc) {
+	ch <- recordEnabledDesc
+	ch <- recordServedDesc
+	ch <- recordChangeDesc
+	ch <- poolRecordsDesc
+	ch <- poolServedDesc
+}
+
+func (c *storeCollector) Collect (ch chan<- prometheus.Metric) {
+	c.Store.mutex.RLock()
+	defer c.Store.mutex.RUnlock()
+
+	for qname := range c.Store.data {
+		for qtype, records := range c.Store.data[qname] {
+			typename := dns.TypeToString[qtype]
+			served := servedRRs(records)
+			ch <- prometheus.MustNewConstMetric(poolRecordsDesc, prometheus.GaugeValue, float64(len(records)), qname, typename)
+			ch <- prometheus.MustNewConstMetric(poolServedDesc, prometheus.GaugeValue, float64(len(served)), qname, typename)
+
+			// Static records have no status of their own
+			for _, record := range records {
+				if record.Uuid == "" { continue }
+				key := RecordKey(record.Data)
+				ch <- prometheus.MustNewConstMetric(recordEnabledDesc, prometheus.GaugeValue, boolValue(record.Enabled), qname, typename, key)
+				ch <- prometheus.MustNewConstMetric(recordServedDesc, prometheus.GaugeValue, boolValue(containsRR(served, record.Data)), qname, typename, key)
+				if !record.LastChange.IsZero() {
+					ch <- prometheus.MustNewConstMetric(recordChangeDesc, prometheus.GaugeValue, float64(record.LastChange.UnixNano()) / 1e9, qname, typename, key)
+				}
+			}
+		}
+	}
+}
+
+func (s *RecordStore) metricName (qname string) (string) {
+	// Called with the read lock held. Names synthesized from
+	// a wildcard are counted under the wildcard.
+	qname = dns.CanonicalName(qname)
+	if len(s.data[qname]) > 0 { return qname }
+	if _, wildcard := lookupNode(s.data, qname); wildcard {
+		apex := "."
+		if zone != nil { apex = zone.Name }
+		closest, _ := closestEncloser(s.data, apex, qname)
+		return "*." + closest
+	}
+	return otherName
+}
+
+func (s *RecordStore) CountQuery (query *dns.Msg, response *dns.Msg) {
+	s.mutex.RLock()
+	name := s.metricName(query.Question[0].Name)
+	s.mutex.RUnlock()
+
+	qtype, ok := dns.TypeToString[query.Question[0].Qtype]
+	if !ok { qtype = "other" }
+	queryCounter.WithLabelValues(name, qtype, dns.RcodeToString[response.Rcode]).Inc()
+}
+
+func countCheck (record *DynRR, success bool, duration time.Duration) {
+	// Called from ApplyResult, with the record still locked
+	name := record.Data.Header().Name
+	typename := dns.TypeToString[record.Data.Header().Rrtype]
+	key := RecordKey(record.Data)
+
+	checkDuration.WithLabelValues(name, typename, key).Observe(duration.Seconds())
+	if !success { checkFailures.WithLabelValues(name, typename, key).Inc() }
+}
+
+func forgetCheck (record *DynRR) {
+	// Drop the series of a record which was removed by a reload
+	name := record.Data.Header().Name
+	typename := dns.TypeToString[record.Data.Header().Rrtype]
+	key := RecordKey(record.Data)
+
+	checkDuration.DeleteLabelValues(name, typename, key)
+	checkFailures.DeleteLabelValues(name, typename, key)
+}
+
+func boolValue (value bool) (float64) {
+	if value { return 1 }
+	return 0
+}
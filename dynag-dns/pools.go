@@ -0,0 +1,60 @@
+package main
+
+import "time"
+import "github.com/miekg/dns"
+
+func servedRRs (records []*DynRR) ([]dns.RR) {
+	var result []dns.RR
+	for _, record := range servedRecords(records) { result = append(result, record.Data) }
+	return result
+}
+
+func servedRecords (records []*DynRR) ([]*DynRR) {
+	// Returns the records which are served for a name and type: the
+	// enabled records of the lowest tier which has any. If everything
+	// is down, `FailOpen` serves all records instead of nothing
+	// (which the caller turns into SERVFAIL), except those drained
+	// by an admin override.
+	now := time.Now()
+	best := -1
+	for _, record := range records {
+		if record.Active(now) && (best == -1 || record.Tier < best) { best = record.Tier }
+	}
+
+	var result []*DynRR
+	for _, record := range records {
+		if record.Active(now) && record.Tier == best { result = append(result, record) }
+	}
+	if len(result) > 0 { return result }
+
+	failopen := false
+	for _, record := range records {
+		if record.FailOpen { failopen = true }
+	}
+	if !failopen { return nil }
+
+	for _, record := range records {
+		if record.Override == nil || record.Override.Enabled { result = append(result, record) }
+	}
+	return result
+}
+
+func diffRRs (before []dns.RR, after []dns.RR) ([]dns.RR, []dns.RR) {
+	// Returns the records removed from and added to `before`
+	var removed, added []dns.RR
+	for _, rr := range before {
+		if !containsRR(after, rr) { removed = append(removed, rr) }
+	}
+	for _, rr := range after {
+		if !containsRR(before, rr) { added = append(added, rr) }
+	}
+	return removed, added
+}
+
+func containsRR (rrs []dns.RR, rr dns.RR) (bool) {
+	// A changed TTL counts as a different record here
+	for _, existing := range rrs {
+		if dns.IsDuplicate(existing, rr) && existing.Header().Ttl == rr.Header().Ttl { return true }
+	}
+	return false
+}
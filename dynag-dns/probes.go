@@ -0,0 +1,313 @@
+package main
+
+import "bytes"
+import "context"
+import "crypto/tls"
+import "errors"
+import "fmt"
+import "io"
+import "net"
+import "net/http"
+import "os"
+import "os/exec"
+import "regexp"
+import "strings"
+import "syscall"
+import "time"
+import "github.com/miekg/dns"
+import config "github.com/olebedev/config"
+
+// Default timeouts (in seconds) for network probes and commands
+const defaultProbeTimeout = 5
+const defaultExecTimeout = 10
+
+// Only this much of a HTTP response body is searched for `body`
+const maxBodySize = 1024 * 1024
+
+type Probe interface {
+	// Returns whether the check succeeded and a short message
+	Check () (bool, string)
+}
+
+type ExecProbe struct {
+	Argv		[]string
+	Timeout		time.Duration
+}
+
+type TCPProbe struct {
+	Address		string
+	Timeout		time.Duration
+}
+
+type HTTPProbe struct {
+	URL		string
+	Method		string
+	Host		string
+	Status		int
+	Body		*regexp.Regexp
+	Insecure	bool
+	Timeout		time.Duration
+}
+
+type TLSProbe struct {
+	Address		string
+	ServerName	string
+	Insecure	bool
+	Expiry		time.Duration
+	Timeout		time.Duration
+}
+
+type DNSProbe struct {
+	Server		string
+	Net		string
+	Question	dns.Question
+	Rcode		int
+	Answer		*regexp.Regexp
+	Timeout		time.Duration
+}
+
+func NewProbe (cfg *config.Config) (Probe, error) {
+	// Without a `check` section, `command` is run (backwards compatible)
+	check, err := cfg.Get("check")
+	if err != nil {
+		argv, argerr := SplitCommand(cfg.UString("command"))
+		if argerr != nil { return nil, argerr }
+		if len(argv) == 0 { return nil, errors.New("Neither check nor command defined") }
+		return &ExecProbe{Argv: argv, Timeout: seconds(defaultExecTimeout)}, nil
+	}
+
+	timeout := seconds(check.UInt("timeout", defaultProbeTimeout))
+
+	switch check.UString("type") {
+	case "exec":
+		// The command can be given as list (argv) or string
+		var argv []string
+		if list, lerr := check.List("command"); lerr == nil {
+			for _, arg := range list { argv = append(argv, fmt.Sprint(arg)) }
+		} else {
+			argv, err = SplitCommand(check.UString("command"))
+			if err != nil { return nil, err }
+		}
+		if len(argv) == 0 { return nil, errors.New("No command defined for exec check") }
+		return &ExecProbe{Argv: argv, Timeout: seconds(check.UInt("timeout", defaultExecTimeout))}, nil
+
+	case "tcp":
+		address := check.UString("address")
+		if _, _, err := net.SplitHostPort(address); err != nil { return nil, err }
+		return &TCPProbe{Address: address, Timeout: timeout}, nil
+
+	case "http":
+		probe := &HTTPProbe{URL: check.UString("url"),
+				    Method: check.UString("method", http.MethodGet),
+				    Host: check.UString("host"),
+				    Status: check.UInt("status", http.StatusOK),
+				    Insecure: check.UBool("insecure"),
+				    Timeout: timeout}
+		if !strings.HasPrefix(probe.URL, "http://") && !strings.HasPrefix(probe.URL, "https://") {
+			return nil, errors.New("Invalid URL for http check: " + probe.URL)
+		}
+		if body := check.UString("body"); body != "" {
+			probe.Body, err = regexp.Compile(body)
+			if err != nil { return nil, err }
+		}
+		return probe, nil
+
+	case "tls":
+		probe := &TLSProbe{Address: check.UString("address"),
+				   ServerName: check.UString("servername"),
+				   Insecure: check.UBool("insecure"),
+				   Expiry: time.Duration(check.UInt("expiry", 0)) * 24 * time.Hour,
+				   Timeout: timeout}
+		host, _, err := net.SplitHostPort(probe.Address)
+		if err != nil { return nil, err }
+		if probe.ServerName == "" { probe.ServerName = host }
+		return probe, nil
+
+	case "dns":
+		probe := &DNSProbe{Server: check.UString("server"),
+				   Net: check.UString("net", "udp"),
+				   Question: dns.Question{Name: dns.Fqdn(check.UString("query")),
+							  Qtype: dns.StringToType[strings.ToUpper(check.UString("qtype", "A"))],
+							  Qclass: dns.ClassINET},
+				   Timeout: timeout}
+		if _, _, err := net.SplitHostPort(probe.Server); err != nil { probe.Server = net.JoinHostPort(probe.Server, "53") }
+		if probe.Question.Qtype == 0 { return nil, errors.New("Unknown qtype for dns check: " + check.UString("qtype")) }
+
+		rcode, ok := dns.StringToRcode[strings.ToUpper(check.UString("rcode", "NOERROR"))]
+		if !ok { return nil, errors.New("Unknown rcode for dns check: " + check.UString("rcode")) }
+		probe.Rcode = rcode
+
+		if answer := check.UString("answer"); answer != "" {
+			probe.Answer, err = regexp.Compile(answer)
+			if err != nil { return nil, err }
+		}
+		return probe, nil
+	}
+
+	return nil, errors.New("Unknown check type: " + check.UString("type"))
+}
+
+func (p *ExecProbe) Check () (bool, string) {
+	output, rcode, err := sysexec(p.Argv[0], p.Argv[1:], nil, nil, p.Timeout)
+	if err != nil { return false, err.Error() }
+
+	// Like with Nagios plugins, the first line is the status
+	status, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	return rcode == 0, status
+}
+
+func (p *TCPProbe) Check () (bool, string) {
+	conn, err := net.DialTimeout("tcp", p.Address, p.Timeout)
+	if err != nil { return false, err.Error() }
+	conn.Close()
+	return true, "Connected to " + p.Address
+}
+
+func (p *HTTPProbe) Check () (bool, string) {
+	request, err := http.NewRequest(p.Method, p.URL, nil)
+	if err != nil { return false, err.Error() }
+	if p.Host != "" { request.Host = p.Host }
+
+	// Don't follow redirects, so the expected status can be a redirect
+	client := &http.Client{Timeout: p.Timeout,
+			       Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: p.Insecure},
+							  DisableKeepAlives: true},
+			       CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	response, err := client.Do(request)
+	if err != nil { return false, err.Error() }
+	defer response.Body.Close()
+
+	if response.StatusCode != p.Status {
+		return false, fmt.Sprintf("Status %d, expected %d", response.StatusCode, p.Status)
+	}
+
+	if p.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(response.Body, maxBodySize))
+		if err != nil { return false, err.Error() }
+		if !p.Body.Match(body) { return false, "Body does not match " + p.Body.String() }
+	}
+
+	return true, fmt.Sprintf("Status %d", response.StatusCode)
+}
+
+func (p *TLSProbe) Check () (bool, string) {
+	dialer := &net.Dialer{Timeout: p.Timeout, Deadline: time.Now().Add(p.Timeout)}
+	conn, err := tls.DialWithDialer(dialer, "tcp", p.Address, &tls.Config{ServerName: p.ServerName, InsecureSkipVerify: p.Insecure})
+	if err != nil { return false, err.Error() }
+	defer conn.Close()
+
+	// Fail before the certificate actually expires
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 { return false, "No certificate presented" }
+	remaining := time.Until(certs[0].NotAfter)
+	if remaining < p.Expiry {
+		return false, fmt.Sprintf("Certificate expires in %d days", int(remaining.Hours() / 24))
+	}
+
+	return true, "Certificate valid until " + certs[0].NotAfter.Format(time.RFC3339)
+}
+
+func (p *DNSProbe) Check () (bool, string) {
+	query := new(dns.Msg)
+	query.Question = []dns.Question{p.Question}
+	query.RecursionDesired = true
+	query.Id = dns.Id()
+
+	client := &dns.Client{Net: p.Net, Timeout: p.Timeout}
+	response, _, err := client.Exchange(query, p.Server)
+	if err != nil { return false, err.Error() }
+
+	if response.Rcode != p.Rcode {
+		return false, fmt.Sprintf("Rcode %s, expected %s", dns.RcodeToString[response.Rcode], dns.RcodeToString[p.Rcode])
+	}
+
+	if p.Answer != nil {
+		for _, rr := range response.Answer {
+			if p.Answer.MatchString(rr.String()) { return true, rr.String() }
+		}
+		return false, "No answer matches " + p.Answer.String()
+	}
+
+	return true, fmt.Sprintf("Rcode %s, %d answers", dns.RcodeToString[response.Rcode], len(response.Answer))
+}
+
+func sysexec (command string, args []string, input []byte, env []string, timeout time.Duration) ([]byte, int, error) {
+	var output bytes.Buffer
+
+	// The process gets killed once the timeout is reached, together with
+	// its children (e.g. a hung curl in a script), as they run in their
+	// own process group. Pipes still held open by anything else are
+	// closed after WaitDelay.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdin = bytes.NewBuffer(input)
+	cmd.Stdout = &output
+	if env != nil { cmd.Env = append(os.Environ(), env...) }
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return output.Bytes(), -1, errors.New("Timeout after " + timeout.String())
+	}
+
+	exitcode := 0
+	if exitError, ok := err.(*exec.ExitError); ok {
+		exitcode = exitError.ExitCode()
+		err = nil
+	}
+
+	return output.Bytes(), exitcode, err
+}
+
+func SplitCommand (command string) ([]string, error) {
+	// Splits a command line into arguments, like a shell would
+	// (without expansion): supports '...', "..." and \ escapes
+	var argv []string
+	var current strings.Builder
+	inarg := false
+	var quote rune
+	escaped := false
+
+	for _, char := range command {
+		switch {
+		case escaped:
+			current.WriteRune(char)
+			escaped = false
+		case char == '\\' && quote != '\'':
+			escaped = true
+			inarg = true
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			} else {
+				current.WriteRune(char)
+			}
+		case char == '\'' || char == '"':
+			quote = char
+			inarg = true
+		case char == ' ' || char == '\t' || char == '\n':
+			if inarg {
+				argv = append(argv, current.String())
+				current.Reset()
+				inarg = false
+			}
+		default:
+			current.WriteRune(char)
+			inarg = true
+		}
+	}
+
+	if escaped || quote != 0 { return nil, errors.New("Unterminated quote or escape in: " + command) }
+	if inarg { argv = append(argv, current.String()) }
+
+	return argv, nil
+}
+
+func seconds (n int) (time.Duration) {
+	return time.Duration(n) * time.Second
+}
@@ -0,0 +1,141 @@
+package main
+
+import "log"
+import "github.com/miekg/dns"
+
+// Maximum number of CNAMEs followed for a single answer
+const maxChase = 8
+
+func lookupNode (dnsdata map[string]map[uint16][]*DynRR, qname string) (map[uint16][]*DynRR, bool) {
+	// Returns the records for `qname`, which are synthesized from a
+	// wildcard if the name does not exist (RFC 4592, 3.3.1). The second
+	// return value is true in that case.
+	if len(dnsdata[qname]) > 0 { return dnsdata[qname], false }
+
+	// Existing names (including empty non-terminals) block wildcards
+	if nameExists(dnsdata, qname) { return nil, false }
+
+	// The source of synthesis is the wildcard at the closest encloser
+	apex := "."
+	if zone != nil { apex = zone.Name }
+	closest, _ := closestEncloser(dnsdata, apex, qname)
+	if node := dnsdata["*." + closest]; len(node) > 0 { return node, true }
+
+	return nil, false
+}
+
+func expandWildcard (rrs []dns.RR, qname string) ([]dns.RR) {
+	// Copies of wildcard records with `qname` as owner
+	var result []dns.RR
+	for _, rr := range rrs {
+		expanded := dns.Copy(rr)
+		expanded.Header().Name = qname
+		result = append(result, expanded)
+	}
+	return result
+}
+
+func (s *RecordStore) resolve (answer *dns.Msg, qname string, qtype uint16) (bool) {
+	// Fills the answer section for `qname` and sets the rcode, following
+	// CNAMEs as long as their target is within our data. Returns false
+	// if nothing can be served (SERVFAIL).
+	visited := make(map[string]bool)
+	for chase := 0; ; chase++ {
+		visited[qname] = true
+		node, wildcard := lookupNode(s.data, qname)
+
+		// If this name is not in the map, we return NXDOMAIN,
+		// unless it exists as an empty non-terminal (NODATA)
+		if node == nil {
+			if !nameExists(s.data, qname) { answer.Rcode = dns.RcodeNameError }
+			return true
+		}
+
+		// A CNAME applies to all types, except CNAME itself
+		if qtype != dns.TypeCNAME && len(node[dns.TypeCNAME]) > 0 {
+			served := servedRRs(node[dns.TypeCNAME])
+			if len(served) == 0 { return false }
+
+			// There can only be one CNAME per name
+			if wildcard { served = expandWildcard(served, qname) }
+			answer.Answer = append(answer.Answer, served[0])
+
+			// Follow the CNAME if we are authoritative for the target
+			target := dns.CanonicalName(served[0].(*dns.CNAME).Target)
+			if visited[target] || chase == maxChase { return true }
+			if zone == nil && len(s.data[target]) == 0 { return true }
+			if zone != nil && !zone.Contains(target) { return true }
+			qname = target
+			continue
+		}
+
+		// If no record for this type exists, we should return empty NOERROR
+		if len(node[qtype]) == 0 { return true }
+
+		// We need to check if at least one record is served (see servedRecords),
+		// every response gets its own order (see Arrange)
+		served := s.Answers.Arrange(servedRecords(node[qtype]))
+		if len(served) == 0 { return false }
+
+		if wildcard { served = expandWildcard(served, qname) }
+		answer.Answer = append(answer.Answer, served...)
+		return true
+	}
+}
+
+func (s *RecordStore) addAdditional (answer *dns.Msg) {
+	// Add addresses for the targets of MX and SRV records, if we have them
+	for _, rr := range answer.Answer {
+		var target string
+		switch record := rr.(type) {
+		case *dns.MX:
+			target = record.Mx
+		case *dns.SRV:
+			target = record.Target
+		default:
+			continue
+		}
+
+		target = dns.CanonicalName(target)
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			for _, address := range servedRRs(s.data[target][qtype]) {
+				if !containsRR(answer.Extra, address) { answer.Extra = append(answer.Extra, address) }
+			}
+		}
+	}
+}
+
+func WarnConflicts (dnsdata map[string]map[uint16][]*DynRR) {
+	// A CNAME can't coexist with other data (RFC 1034, 3.6.2)
+	for qname, node := range dnsdata {
+		if len(node[dns.TypeCNAME]) == 0 { continue }
+		if len(node[dns.TypeCNAME]) > 1 {
+			log.Printf("Warning: %s has more than one CNAME, only the first served one is used\n", qname)
+		}
+		for qtype, records := range node {
+			if qtype != dns.TypeCNAME && len(records) > 0 {
+				log.Printf("Warning: %s has a CNAME and %s records\n", qname, dns.TypeToString[qtype])
+			}
+		}
+	}
+}
+
+func negativeAnswer (answer *dns.Msg, dnsdata map[string]map[uint16][]*DynRR) (string, bool) {
+	// Returns the name an answer ends at after following its CNAMEs, and
+	// whether it is a negative answer (NXDOMAIN or NODATA) for that name.
+	// CNAMEs to names we don't know about are positive answers.
+	qname := dns.CanonicalName(answer.Question[0].Name)
+	qtype := answer.Question[0].Qtype
+	for _, rr := range answer.Answer {
+		if dns.CanonicalName(rr.Header().Name) != qname { continue }
+		if cname, ok := rr.(*dns.CNAME); ok && qtype != dns.TypeCNAME {
+			qname = dns.CanonicalName(cname.Target)
+			continue
+		}
+		return qname, false
+	}
+
+	if answer.Rcode == dns.RcodeNameError { return qname, true }
+	node, _ := lookupNode(dnsdata, qname)
+	return qname, node != nil || nameExists(dnsdata, qname)
+}
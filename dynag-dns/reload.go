@@ -0,0 +1,201 @@
+package main
+
+import "encoding/json"
+import "log"
+import "os"
+import "os/signal"
+import "sync"
+import "syscall"
+import "time"
+import "github.com/miekg/dns"
+import config "github.com/olebedev/config"
+
+// Options of a `names` entry which can change without resetting the health state
+var tunables = []string{"name", "rr", "interval", "rise", "fall", "damping", "tier", "failopen", "dnssec", "weight"}
+
+// Serializes reloads, and protects `configModTime`
+var reloadMutex sync.Mutex
+var configModTime time.Time
+
+func CheckDefinition (rr dns.RR, nameconf *config.Config) (string) {
+	// Identifies a record and its health check across reloads. It
+	// contains everything which makes a previous check result invalid.
+	definition := RecordKey(rr)
+
+	if entry, ok := nameconf.Root.(map[string]interface{}); ok {
+		check := make(map[string]interface{})
+		for key, value := range entry { check[key] = value }
+		for _, key := range tunables { delete(check, key) }
+
+		// Maps are marshalled with sorted keys, so this is stable
+		content, _ := json.Marshal(check)
+		definition += " " + string(content)
+	}
+
+	return definition
+}
+
+func (record *DynRR) TakeState (previous *DynRR) {
+	// Continue with the health state of the same record before a reload
+	record.Enabled = previous.Enabled
+	record.Uuid = previous.Uuid
+	record.LastChange = previous.LastChange
+	record.Successes = previous.Successes
+	record.Failures = previous.Failures
+	record.Penalty = previous.Penalty
+	record.Suppressed = previous.Suppressed
+	record.LastCheck = previous.LastCheck
+	record.LastOutput = previous.LastOutput
+	record.Latency = previous.Latency
+	record.Stale = previous.Stale
+}
+
+func (s *RecordStore) Reload (loaded *LoadedConfig) {
+	// Switches to newly loaded records, zone and signers. Records whose
+	// definition did not change keep their health state and UUID.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := make(map[string][]*DynRR)
+	overrides := make(map[string]*Override)
+	for qname := range s.data {
+		for _, records := range s.data[qname] {
+			for _, record := range records {
+				if record.Uuid != "" { previous[record.Definition] = append(previous[record.Definition], record) }
+				if record.Override != nil { overrides[RecordKey(record.Data)] = record.Override }
+			}
+		}
+	}
+
+	kept, fresh := 0, 0
+	keys := make(map[string]bool)
+	for qname := range loaded.Data {
+		for _, records := range loaded.Data[qname] {
+			for _, record := range records {
+				keys[RecordKey(record.Data)] = true
+				if record.Uuid != "" {
+					if matches := previous[record.Definition]; len(matches) > 0 {
+						record.TakeState(matches[0])
+						previous[record.Definition] = matches[1:]
+						kept++
+					} else {
+						fresh++
+					}
+				}
+				record.Override = overrides[RecordKey(record.Data)]
+			}
+		}
+	}
+
+	// Metrics of records which are gone would stay forever
+	for _, records := range previous {
+		for _, record := range records {
+			if !keys[RecordKey(record.Data)] { forgetCheck(record) }
+		}
+	}
+
+	// Secondaries only see a new serial if the zone changed
+	if zone != nil && loaded.Zone != nil && zone.Name == loaded.Zone.Name {
+		loaded.Zone.Continue(zone, s.data, loaded.Data)
+	} else if loaded.Zone != nil {
+		log.Printf("Serving zone %s with serial %d\n", loaded.Zone.Name, loaded.Zone.Serial())
+	}
+
+	// Pending notifications are still sent by the old hooks
+	if s.Hooks != nil { s.Hooks.Stop() }
+	s.Hooks = loaded.Hooks
+	if s.Hooks != nil { s.Hooks.Start() }
+	s.Answers = loaded.Answers
+
+	if zone != nil { zone.StopNotify() }
+	zone = loaded.Zone
+	signers = loaded.Signers
+	s.data = loaded.Data
+	s.uuids = make(map[string]*DynRR)
+	s.index()
+
+	if err := s.saveOverrides(); err != nil { log.Printf("Failed to save overrides: %s\n", err) }
+
+	log.Printf("Reloaded configuration: %d records kept their status, %d are new\n", kept, fresh)
+}
+
+func (z *Zone) Continue (old *Zone, olddata map[string]map[uint16][]*DynRR, newdata map[string]map[uint16][]*DynRR) {
+	// Takes over serial and journal of the zone served so far
+	// and increases the serial if the served data changed
+	old.mutex.Lock()
+	oldsoa := old.SOA
+	journal := append([]zoneChange{}, old.journal...)
+	old.mutex.Unlock()
+
+	z.mutex.Lock()
+	z.SOA.Serial = oldsoa.Serial
+	z.journal = journal
+	soa := dns.Copy(z.SOA).(*dns.SOA)
+	z.mutex.Unlock()
+
+	// Changed SOA timers or TTL also need a new serial
+	removed, added := diffRRs(old.records(olddata), z.records(newdata))
+	if len(removed) + len(added) > 0 || oldsoa.String() != soa.String() {
+		z.Bump(removed, added)
+	}
+}
+
+func Reload (configpath string) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	reload(configpath)
+}
+
+func reload (configpath string) {
+	// Errors leave the running configuration untouched
+	log.Printf("Reloading configuration from %s\n", configpath)
+	cfg, conferr := config.ParseJsonFile(configpath)
+	if conferr != nil {
+		log.Printf("Failed to reload configuration: %s\n", conferr)
+		return
+	}
+
+	loaded, loaderr := LoadData(cfg)
+	if loaderr != nil {
+		log.Printf("Failed to reload configuration: %s\n", loaderr)
+		return
+	}
+
+	runningConfig = cfg
+	activate(loaded)
+}
+
+func activate (loaded *LoadedConfig) {
+	// Switches everything to `loaded`, called with `reloadMutex` held
+	store.Reload(loaded)
+	loaded.Update.Activate()
+	checks.Sync(loaded.Checks)
+	checks.RunDue()
+}
+
+func ReloadOnSignal (configpath string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		Reload(configpath)
+	}
+}
+
+func WatchConfig (configpath string) {
+	// Reloads if the modification time of the file changed
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	info, err := os.Stat(configpath)
+	if err != nil { return }
+
+	// The first call only remembers the current state
+	if configModTime.IsZero() {
+		configModTime = info.ModTime()
+		return
+	}
+	if info.ModTime().Equal(configModTime) { return }
+	configModTime = info.ModTime()
+
+	reload(configpath)
+}
@@ -0,0 +1,141 @@
+package main
+
+import "encoding/json"
+import "log"
+import "os"
+import "os/signal"
+import "sync"
+import "syscall"
+import "time"
+
+type savedState struct {
+	// Health state of a record, identified by its definition (see CheckDefinition)
+	Record		string		`json:"record"`
+	Enabled		bool		`json:"enabled"`
+	LastChange	time.Time	`json:"last_change"`
+	LastCheck	time.Time	`json:"last_check"`
+	LastOutput	string		`json:"last_output,omitempty"`
+	Successes	int		`json:"successes"`
+	Failures	int		`json:"failures"`
+	Penalty		float64		`json:"penalty,omitempty"`
+	Suppressed	bool		`json:"suppressed,omitempty"`
+}
+
+type stateFile struct {
+	// Serial of the zone (if any) and health state of the records
+	Serial		uint32		`json:"serial,omitempty"`
+	Records		[]savedState	`json:"records"`
+}
+
+// Whether restored records are served before their first check
+var serveStale = true
+
+// Only one state file is written at a time
+var stateMutex sync.Mutex
+
+func (s *RecordStore) SaveState () {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if err := s.saveState(); err != nil { log.Printf("Failed to save state to %s: %s\n", s.StateFile, err) }
+}
+
+func (s *RecordStore) saveState () (error) {
+	// Called with (at least) the read lock held. Writes the health
+	// state of all records with a check and the zone serial to `StateFile`.
+	if s.StateFile == "" { return nil }
+
+	var state stateFile
+	if zone != nil { state.Serial = zone.Serial() }
+	for qname := range s.data {
+		for _, records := range s.data[qname] {
+			for _, record := range records {
+				// Nothing is known about records which were never checked
+				if record.Uuid == "" || record.LastCheck.IsZero() { continue }
+				state.Records = append(state.Records, savedState{Record: record.Definition,
+								 Enabled: record.Enabled,
+								 LastChange: record.LastChange,
+								 LastCheck: record.LastCheck,
+								 LastOutput: record.LastOutput,
+								 Successes: record.Successes,
+								 Failures: record.Failures,
+								 Penalty: record.Penalty,
+								 Suppressed: record.Suppressed})
+			}
+		}
+	}
+
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil { return err }
+
+	// Write to a temporary file first, so we never leave a broken file
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	if err := os.WriteFile(s.StateFile + ".tmp", content, 0600); err != nil { return err }
+	return os.Rename(s.StateFile + ".tmp", s.StateFile)
+}
+
+func (s *RecordStore) LoadState (maxage time.Duration) (error) {
+	// Restores the state saved by a previous run, before any checks ran.
+	// Restored records are stale until their first check result arrives.
+	if s.StateFile == "" { return nil }
+
+	content, err := os.ReadFile(s.StateFile)
+	if os.IsNotExist(err) { return nil }
+	if err != nil { return err }
+
+	// Older versions saved the records only
+	var state stateFile
+	if err := json.Unmarshal(content, &state); err != nil {
+		if err := json.Unmarshal(content, &state.Records); err != nil { return err }
+	}
+
+	saved := make(map[string][]savedState)
+	for _, entry := range state.Records {
+		// Too old to be of any use (if `maxage` is set)
+		if maxage > 0 && time.Since(entry.LastCheck) > maxage { continue }
+		saved[entry.Record] = append(saved[entry.Record], entry)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// The serial must not go backwards, even if we restart quickly
+	// after many changes
+	if zone != nil && state.Serial != 0 { zone.Restore(state.Serial) }
+
+	restored := 0
+	for qname := range s.data {
+		for _, records := range s.data[qname] {
+			for _, record := range records {
+				matches := saved[record.Definition]
+				if record.Uuid == "" || len(matches) == 0 { continue }
+				saved[record.Definition] = matches[1:]
+
+				record.Enabled = matches[0].Enabled
+				record.LastChange = matches[0].LastChange
+				record.LastCheck = matches[0].LastCheck
+				record.LastOutput = matches[0].LastOutput
+				record.Successes = matches[0].Successes
+				record.Failures = matches[0].Failures
+				record.Penalty = matches[0].Penalty
+				record.Suppressed = matches[0].Suppressed
+				record.Stale = true
+				restored++
+			}
+		}
+	}
+
+	log.Printf("Restored state of %d records from %s\n", restored, s.StateFile)
+	return nil
+}
+
+func SaveStateOnExit () {
+	// Save the state on SIGINT and SIGTERM, so a restart loses nothing
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+
+	log.Printf("Received %s, saving state and exiting\n", sig)
+	store.SaveState()
+	os.Exit(0)
+}
@@ -0,0 +1,186 @@
+package main
+
+import "log"
+import "sync"
+import "time"
+import "github.com/miekg/dns"
+
+type RecordStore struct {
+	// All records, see `dnsdata` in main(). Queries are answered under
+	// the read lock, check results are applied under the write lock.
+	// Records in `data` are never changed while answers are built,
+	// so the dns.RR objects can be handed out without copying.
+	mutex		sync.RWMutex
+	data		map[string]map[uint16][]*DynRR
+	uuids		map[string]*DynRR
+	OverrideFile	string
+	StateFile	string
+	Hooks		*Hooks
+	Answers		AnswerConf
+}
+
+// The store all DNS handlers answer from
+var store *RecordStore
+
+func NewRecordStore (dnsdata map[string]map[uint16][]*DynRR) (*RecordStore) {
+	s := &RecordStore{data: dnsdata, uuids: make(map[string]*DynRR)}
+	s.index()
+	return s
+}
+
+func (s *RecordStore) index () {
+	// Index records with a health check by their UUID
+	for qname := range s.data {
+		for qtype := range s.data[qname] {
+			for _, record := range s.data[qname][qtype] {
+				if record.Uuid != "" { s.uuids[record.Uuid] = record }
+			}
+		}
+	}
+}
+
+func (s *RecordStore) Zone () (*Zone) {
+	// The zone is replaced by reloads (see Reload)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return zone
+}
+
+func (s *RecordStore) ProcessResults (results chan checkResult) {
+	// Apply check results until the channel is closed
+	for check := range results {
+		s.ApplyResult(check)
+	}
+}
+
+func (s *RecordStore) ApplyResult (check checkResult) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Find the record this check result applies to
+	record, ok := s.uuids[check.Uuid]
+	if !ok { return }
+
+	qname := record.Data.Header().Name
+	qtype := record.Data.Header().Rrtype
+
+	record.LastCheck = time.Now()
+	record.LastOutput = check.Output
+	record.Latency = check.Duration
+	countCheck(record, check.Success, check.Duration)
+
+	// Count the result, which may not be enough to change the status yet.
+	// Either way, restored state is confirmed now.
+	before := servedRRs(s.data[qname][qtype])
+	stale := record.Stale
+	record.Stale = false
+	if !record.Apply(check.Success, time.Now()) {
+		if record.Enabled != check.Success {
+			log.Printf("Check for %s is %s (%s) [%s]\n",
+			record.Data.String(),
+			UpBool(check.Success),
+			check.Output,
+			record.Counters())
+		}
+		if stale { s.changed(qname, qtype, before) }
+		return
+	}
+
+	// Log the status change (LastChange has the timestamp, for debugging)
+	log.Printf("Status change for %s to %s (%s) [%s]\n",
+	record.Data.String(),
+	UpBool(check.Success),
+	check.Output,
+	record.Counters())
+
+	s.changed(qname, qtype, before)
+
+	// Tell the hooks, if configured
+	if s.Hooks != nil {
+		s.Hooks.Fire(StateChange{Record: RecordKey(record.Data),
+					 Name: qname,
+					 Type: dns.TypeToString[qtype],
+					 OldState: StateName(!record.Enabled),
+					 NewState: StateName(record.Enabled),
+					 Output: check.Output,
+					 Served: len(servedRRs(s.data[qname][qtype])),
+					 Time: record.LastChange})
+	}
+
+	// Save status changes right away, counters are saved regularly
+	if err := s.saveState(); err != nil { log.Printf("Failed to save state to %s: %s\n", s.StateFile, err) }
+}
+
+func (s *RecordStore) changed (qname string, qtype uint16, before []dns.RR) {
+	// Called with the write lock held after the status of a record
+	// changed, `before` are the records served before the change
+	after := servedRRs(s.data[qname][qtype])
+
+	// Cached signatures no longer match the served RRset
+	if signer := FindSigner(qname); signer != nil {
+		signer.Invalidate(qname)
+	}
+
+	// Let secondaries know if the served data changed, which
+	// may involve other records with tiers or fail open
+	removed, added := diffRRs(before, after)
+	if zone != nil && zone.Contains(qname) && len(removed) + len(added) > 0 {
+		zone.Bump(removed, added)
+
+		// The new serial is saved right away (see LoadState)
+		if err := s.saveState(); err != nil { log.Printf("Failed to save state to %s: %s\n", s.StateFile, err) }
+	}
+}
+
+func (s *RecordStore) Answer (query *dns.Msg) (*dns.Msg) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// Setup an answer object
+	answer := new(dns.Msg)
+	answer.MsgHdr.Authoritative = true
+	answer.Compress = false
+
+	// Handle non INET class (respond with NOTIMP)
+	if query.Question[0].Qclass != dns.ClassINET {
+		answer.SetRcode(query, dns.StringToRcode["NOTIMP"])
+		return answer
+	}
+
+	qname := dns.CanonicalName(query.Question[0].Name)
+	qtype := query.Question[0].Qtype
+
+	// Zone transfers are only possible with a configured zone
+	if qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		if zone == nil || qname != zone.Name {
+			answer.SetRcode(query, dns.StringToRcode["REFUSED"])
+			return answer
+		}
+		return zone.TransferAnswer(query, s.data)
+	}
+
+	// We are not authoritative for names outside the zone
+	if zone != nil && !zone.Contains(qname) {
+		answer.SetRcode(query, dns.StringToRcode["REFUSED"])
+		answer.MsgHdr.Authoritative = false
+		return answer
+	}
+
+	// Find the records, following CNAMEs and wildcards. If nothing
+	// can be served, return SERVFAIL, to prevent caching.
+	answer.SetReply(query)
+	if !s.resolve(answer, qname, qtype) {
+		answer.SetRcode(query, dns.StringToRcode["SERVFAIL"])
+		answer.Answer = nil
+		return answer
+	}
+
+	if zone != nil { zone.AddAuthority(answer, s.data) }
+	s.addAdditional(answer)
+	SignAnswer(query, answer, s.data)
+
+	// Clients with EDNS learn our UDP size (see Truncate)
+	if query.IsEdns0() != nil && answer.IsEdns0() == nil { answer.SetEdns0(maxUDPSize, false) }
+
+	return answer
+}
@@ -0,0 +1,147 @@
+package main
+
+import "fmt"
+import "io"
+import "log"
+import "math/rand"
+import "net"
+import "os"
+import "sync"
+import "testing"
+import "time"
+import "github.com/miekg/dns"
+
+const loadNames = 200
+const loadClients = 40
+const loadQueries = 250
+
+func startTestServer (t *testing.T, network string) (string, func()) {
+	// Starts a server with handleDnsRequest on a random port
+	started := make(chan bool)
+	server := &dns.Server{Net: network, Handler: dns.HandlerFunc(handleDnsRequest),
+			      NotifyStartedFunc: func() { close(started) }}
+
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil { t.Fatal(err) }
+		server.PacketConn = conn
+	} else {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil { t.Fatal(err) }
+		server.Listener = listener
+	}
+
+	go func() { _ = server.ActivateAndServe() }()
+	<-started
+
+	if server.PacketConn != nil { return server.PacketConn.LocalAddr().String(), func() { _ = server.Shutdown() } }
+	return server.Listener.Addr().String(), func() { _ = server.Shutdown() }
+}
+
+func TestConcurrentAnswersMatchQuestions (t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	zone = nil
+
+	// Every name has a single address which is derived from its number
+	dnsdata := make(map[string]map[uint16][]*DynRR)
+	var uuids []string
+	for i := 0; i < loadNames; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("host%d.example.org. 60 IN A 10.0.%d.%d", i, i / 256, i % 256))
+		record := &DynRR{Data: rr, Enabled: true, Uuid: GenerateUUID(), Rise: 1, Fall: 1}
+		dnsdata[rr.Header().Name] = map[uint16][]*DynRR{dns.TypeA: {record}}
+		uuids = append(uuids, record.Uuid)
+	}
+	store = NewRecordStore(dnsdata)
+
+	udpaddr, udpstop := startTestServer(t, "udp")
+	defer udpstop()
+	tcpaddr, tcpstop := startTestServer(t, "tcp")
+	defer tcpstop()
+
+	// Keep changing the status of records while the queries run
+	done := make(chan bool)
+	flipped := make(chan bool)
+	go func() {
+		defer close(flipped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Microsecond):
+				store.ApplyResult(checkResult{Uuid: uuids[rand.Intn(len(uuids))], Success: rand.Intn(2) == 0})
+			}
+		}
+	}()
+	defer func() { close(done); <-flipped }()
+
+	var wg sync.WaitGroup
+	errors := make(chan error, loadClients)
+	for c := 0; c < loadClients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+
+			client := &dns.Client{Net: "udp"}
+			server := udpaddr
+			if c % 2 == 1 {
+				client.Net = "tcp"
+				server = tcpaddr
+			}
+
+			for q := 0; q < loadQueries; q++ {
+				i := rand.Intn(loadNames)
+				query := new(dns.Msg)
+				query.SetQuestion(fmt.Sprintf("host%d.example.org.", i), dns.TypeA)
+
+				response, _, err := client.Exchange(query, server)
+				if err != nil { errors <- err; return }
+
+				if response.Id != query.Id || response.Question[0].Name != query.Question[0].Name {
+					errors <- fmt.Errorf("Got answer for %s (id %d) to %s (id %d)", response.Question[0].Name,
+							     response.Id, query.Question[0].Name, query.Id)
+					return
+				}
+
+				// Disabled records give SERVFAIL, otherwise it must be our address
+				if response.Rcode == dns.RcodeServerFailure { continue }
+				expected := net.IPv4(10, 0, byte(i / 256), byte(i % 256))
+				if len(response.Answer) != 1 || !response.Answer[0].(*dns.A).A.Equal(expected) {
+					errors <- fmt.Errorf("Wrong answer for %s: %v", query.Question[0].Name, response.Answer)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(errors)
+
+	for err := range errors {
+		t.Error(err)
+	}
+}
+
+func TestApplyResultByUuid (t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	zone = nil
+
+	rr, _ := dns.NewRR("www.example.org. 60 IN A 192.0.2.1")
+	record := &DynRR{Data: rr, Uuid: GenerateUUID(), Rise: 1, Fall: 1}
+	s := NewRecordStore(map[string]map[uint16][]*DynRR{"www.example.org.": {dns.TypeA: {record}}})
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.org.", dns.TypeA)
+	if rcode := s.Answer(query).Rcode; rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected SERVFAIL before the first check, got %s", dns.RcodeToString[rcode])
+	}
+
+	s.ApplyResult(checkResult{Uuid: record.Uuid, Success: true})
+	if answer := s.Answer(query); answer.Rcode != dns.RcodeSuccess || len(answer.Answer) != 1 {
+		t.Errorf("Expected the record after a successful check, got %v", answer)
+	}
+
+	// Results for unknown UUIDs are ignored
+	s.ApplyResult(checkResult{Uuid: GenerateUUID(), Success: false})
+	if !record.Enabled { t.Error("Result for another UUID changed the record") }
+}
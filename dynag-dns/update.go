@@ -0,0 +1,523 @@
+package main
+
+import "crypto/hmac"
+import "crypto/sha1"
+import "crypto/sha256"
+import "crypto/sha512"
+import "encoding/base64"
+import "encoding/hex"
+import "encoding/json"
+import "errors"
+import "hash"
+import "log"
+import "net"
+import "os"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+import "github.com/miekg/dns"
+import config "github.com/olebedev/config"
+
+// TXT records at this label below a name define the check for records added
+// with UPDATE, e.g. _check.www.example.org. TXT "type=tcp address={host}:80"
+const checkLabel = "_check."
+
+type tsigKey struct {
+	Algorithm	string
+	Secret		string
+}
+
+type UpdateConf struct {
+	// The `update` section: TSIG keys allowed to update the zone, where
+	// to keep added records and a template for their `names` entries
+	Keys		map[string]tsigKey
+	File		string
+	Template	map[string]interface{}
+	AllowExec	bool
+}
+
+type DynamicRecords struct {
+	// Records added with UPDATE and the checks from companion TXT records
+	Records		[]string		`json:"records"`
+	Checks		map[string]string	`json:"checks"`
+}
+
+type KeyRing struct {
+	// Implements dns.TsigProvider with the keys of the running configuration
+	mutex		sync.RWMutex
+	keys		map[string]tsigKey
+}
+
+// Records added with UPDATE, protected by `reloadMutex`
+var dynamic = &DynamicRecords{Checks: make(map[string]string)}
+
+// TSIG keys for all servers
+var keyring = &KeyRing{keys: make(map[string]tsigKey)}
+
+// The `update` section and the file the running configuration
+// was loaded from, to rebuild everything after an update
+var updateconf *UpdateConf
+var runningConfig *config.Config
+
+func LoadUpdateConf (cfg *config.Config) (*UpdateConf, error) {
+	updconf, err := cfg.Get("update")
+	if err != nil { return nil, nil }
+
+	conf := &UpdateConf{Keys: make(map[string]tsigKey), File: updconf.UString("file"), AllowExec: updconf.UBool("exec")}
+	for i := range updconf.UList("keys") {
+		keyconf, _ := updconf.Get("keys." + strconv.Itoa(i))
+		name := dns.CanonicalName(keyconf.UString("name"))
+		algorithm := dns.CanonicalName(keyconf.UString("algorithm", "hmac-sha256"))
+		secret := keyconf.UString("secret")
+
+		if name == "." || secret == "" { return nil, errors.New("TSIG keys need a name and a secret") }
+		if _, err := base64.StdEncoding.DecodeString(secret); err != nil { return nil, errors.New("Invalid secret for TSIG key " + name) }
+		if tsigHash(algorithm) == nil { return nil, errors.New("Unsupported algorithm for TSIG key " + name + ": " + algorithm) }
+
+		conf.Keys[name] = tsigKey{Algorithm: algorithm, Secret: secret}
+	}
+	if len(conf.Keys) == 0 { return nil, errors.New("No keys defined for updates") }
+
+	if template, err := updconf.Get("template"); err == nil {
+		conf.Template, _ = template.Root.(map[string]interface{})
+	}
+
+	return conf, nil
+}
+
+func LoadDynamic (filename string) (error) {
+	// Restores the records added with UPDATE before the last restart
+	if filename == "" { return nil }
+
+	content, err := os.ReadFile(filename)
+	if os.IsNotExist(err) { return nil }
+	if err != nil { return err }
+
+	loaded := &DynamicRecords{}
+	if err := json.Unmarshal(content, loaded); err != nil { return err }
+	if loaded.Checks == nil { loaded.Checks = make(map[string]string) }
+	dynamic = loaded
+
+	log.Printf("Loaded %d dynamic records from %s\n", len(dynamic.Records), filename)
+	return nil
+}
+
+func (d *DynamicRecords) Save (filename string) (error) {
+	if filename == "" { return nil }
+
+	content, err := json.MarshalIndent(d, "", "  ")
+	if err != nil { return err }
+
+	// Write to a temporary file first, so we never leave a broken file
+	if err := os.WriteFile(filename + ".tmp", content, 0600); err != nil { return err }
+	return os.Rename(filename + ".tmp", filename)
+}
+
+func (d *DynamicRecords) Copy () (*DynamicRecords) {
+	result := &DynamicRecords{Records: append([]string{}, d.Records...), Checks: make(map[string]string)}
+	for owner, check := range d.Checks { result.Checks[owner] = check }
+	return result
+}
+
+func (d *DynamicRecords) Entries (conf *UpdateConf) ([]*config.Config) {
+	// Turns the dynamic records into `names` entries for LoadData
+	var entries []*config.Config
+	for _, text := range d.Records {
+		rr, err := dns.NewRR(text)
+		if err != nil || rr == nil { continue }
+		owner := rr.Header().Name
+
+		entry := make(map[string]interface{})
+		if spec, ok := d.Checks[owner]; ok {
+			entry = ParseCheckSpec(spec)
+		} else if conf != nil && conf.Template != nil {
+			for key, value := range conf.Template { entry[key] = value }
+		}
+		entry = substitute(entry, rr).(map[string]interface{})
+		entry["name"] = owner
+		entry["rr"] = strings.TrimSpace(strings.TrimPrefix(rr.String(), owner))
+
+		content, _ := json.Marshal(entry)
+		entryconf, err := config.ParseJson(string(content))
+		if err != nil { continue }
+		entries = append(entries, entryconf)
+	}
+	return entries
+}
+
+func ParseCheckSpec (spec string) (map[string]interface{}) {
+	// "type=http url=http://{host}/health interval=10" becomes a `names`
+	// entry with a `check` section. Options of the entry itself are
+	// taken out of the check.
+	entry := make(map[string]interface{})
+	check := make(map[string]interface{})
+
+	fields, _ := SplitCommand(spec)
+	for _, field := range fields {
+		key, text, found := strings.Cut(field, "=")
+		if !found { continue }
+
+		var value interface{} = text
+		if number, err := strconv.Atoi(text); err == nil {
+			value = number
+		} else if flag, err := strconv.ParseBool(text); err == nil {
+			value = flag
+		}
+
+		switch key {
+		case "interval", "rise", "fall", "tier", "failopen":
+			entry[key] = value
+		default:
+			check[key] = value
+		}
+	}
+
+	if len(check) > 0 { entry["check"] = check }
+	return entry
+}
+
+func substitute (value interface{}, rr dns.RR) (interface{}) {
+	// Replaces {rdata} with the data of `rr` and {host} with its
+	// address, in brackets for IPv6 (for URLs and host:port)
+	switch value := value.(type) {
+	case string:
+		rdata := strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String()))
+		host := rdata
+		if aaaa, ok := rr.(*dns.AAAA); ok { host = "[" + aaaa.AAAA.String() + "]" }
+		return strings.ReplaceAll(strings.ReplaceAll(value, "{rdata}", rdata), "{host}", host)
+	case map[string]interface{}:
+		result := make(map[string]interface{})
+		for key, item := range value { result[key] = substitute(item, rr) }
+		return result
+	case []interface{}:
+		var result []interface{}
+		for _, item := range value { result = append(result, substitute(item, rr)) }
+		return result
+	}
+	return value
+}
+
+func tsigHash (algorithm string) (func() hash.Hash) {
+	switch dns.CanonicalName(algorithm) {
+	case dns.HmacSHA1:
+		return sha1.New
+	case dns.HmacSHA224:
+		return sha256.New224
+	case dns.HmacSHA256:
+		return sha256.New
+	case dns.HmacSHA384:
+		return sha512.New384
+	case dns.HmacSHA512:
+		return sha512.New
+	}
+	return nil
+}
+
+func (k *KeyRing) Set (keys map[string]tsigKey) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.keys = keys
+}
+
+func (k *KeyRing) Generate (msg []byte, t *dns.TSIG) ([]byte, error) {
+	k.mutex.RLock()
+	key, ok := k.keys[dns.CanonicalName(t.Hdr.Name)]
+	k.mutex.RUnlock()
+	if !ok { return nil, dns.ErrSecret }
+
+	if dns.CanonicalName(t.Algorithm) != key.Algorithm { return nil, dns.ErrKeyAlg }
+	secret, err := base64.StdEncoding.DecodeString(key.Secret)
+	if err != nil { return nil, err }
+
+	mac := hmac.New(tsigHash(key.Algorithm), secret)
+	mac.Write(msg)
+	return mac.Sum(nil), nil
+}
+
+func (k *KeyRing) Verify (msg []byte, t *dns.TSIG) (error) {
+	expected, err := k.Generate(msg, t)
+	if err != nil { return err }
+
+	mac, err := hex.DecodeString(t.MAC)
+	if err != nil { return err }
+	if !hmac.Equal(expected, mac) { return dns.ErrSig }
+	return nil
+}
+
+func AcceptMessage (dh dns.Header) (dns.MsgAcceptAction) {
+	// The default rejects UPDATE, as it has records in all sections
+	opcode := int(dh.Bits >> 11) & 0xF
+	if opcode == dns.OpcodeUpdate && dh.Bits & (1 << 15) == 0 {
+		if dh.Qdcount != 1 { return dns.MsgReject }
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+func (c *UpdateConf) Activate () {
+	// Called with `reloadMutex` held (or before the servers start)
+	updateconf = c
+	keys := make(map[string]tsigKey)
+	if c != nil { keys = c.Keys }
+	keyring.Set(keys)
+}
+
+func handleUpdate (w dns.ResponseWriter, r *dns.Msg) {
+	// Processes an UPDATE message (RFC 2136, 3)
+	response := new(dns.Msg)
+	response.SetReply(r)
+	response.SetRcode(r, Update(w, r))
+
+	// Sign the response with the key of the request
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		response.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+
+	log.Printf("UPDATE for %s from %s: %s\n", r.Question[0].Name, w.RemoteAddr(), dns.RcodeToString[response.Rcode])
+	werr := w.WriteMsg(response)
+	if werr != nil { log.Println(werr) }
+}
+
+func Update (w dns.ResponseWriter, r *dns.Msg) (int) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	// Only signed updates for our zone are accepted
+	current := store.Zone()
+	if updateconf == nil || current == nil { return dns.RcodeRefused }
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA { return dns.RcodeFormatError }
+	if dns.CanonicalName(r.Question[0].Name) != current.Name { return dns.RcodeNotAuth }
+	if r.IsTsig() == nil { return dns.RcodeRefused }
+	if err := w.TsigStatus(); err != nil {
+		log.Printf("TSIG verification failed for UPDATE from %s: %s\n", w.RemoteAddr(), err)
+		return dns.RcodeNotAuth
+	}
+
+	// All names must be within the zone
+	for _, rr := range append(append([]dns.RR{}, r.Answer...), r.Ns...) {
+		if !current.Contains(rr.Header().Name) { return dns.RcodeNotZone }
+	}
+
+	if rcode := store.Prerequisites(r.Answer); rcode != dns.RcodeSuccess { return rcode }
+
+	// Apply the changes to a copy, so nothing changes if one of them fails
+	changed := dynamic.Copy()
+	for _, rr := range r.Ns {
+		if rcode := store.applyUpdate(changed, rr, current.Name); rcode != dns.RcodeSuccess { return rcode }
+	}
+
+	if err := changed.Save(updateconf.File); err != nil {
+		log.Printf("Failed to save dynamic records to %s: %s\n", updateconf.File, err)
+		return dns.RcodeServerFailure
+	}
+	previous := dynamic
+	dynamic = changed
+
+	// Rebuild everything from the running configuration, so
+	// unchanged records keep their status (see Reload)
+	loaded, loaderr := LoadData(runningConfig)
+	if loaderr != nil {
+		log.Printf("Failed to apply UPDATE: %s\n", loaderr)
+		dynamic = previous
+		_ = previous.Save(updateconf.File)
+		return dns.RcodeServerFailure
+	}
+	activate(loaded)
+
+	return dns.RcodeSuccess
+}
+
+func (s *RecordStore) Prerequisites (prereqs []dns.RR) (int) {
+	// Checks the prerequisite section (RFC 2136, 3.2) against all
+	// records, regardless of their status
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// RRsets which must exist with exactly these records
+	required := make(map[string][]dns.RR)
+
+	for _, rr := range prereqs {
+		header := rr.Header()
+		name := dns.CanonicalName(header.Name)
+		if header.Ttl != 0 { return dns.RcodeFormatError }
+
+		switch header.Class {
+		case dns.ClassANY:
+			if header.Rdlength != 0 { return dns.RcodeFormatError }
+			if header.Rrtype == dns.TypeANY {
+				if len(s.data[name]) == 0 { return dns.RcodeNameError }
+			} else if len(s.data[name][header.Rrtype]) == 0 {
+				return dns.RcodeNXRrset
+			}
+
+		case dns.ClassNONE:
+			if header.Rdlength != 0 { return dns.RcodeFormatError }
+			if header.Rrtype == dns.TypeANY {
+				if len(s.data[name]) > 0 { return dns.RcodeYXDomain }
+			} else if len(s.data[name][header.Rrtype]) > 0 {
+				return dns.RcodeYXRrset
+			}
+
+		case dns.ClassINET:
+			key := name + "/" + strconv.Itoa(int(header.Rrtype))
+			required[key] = append(required[key], rr)
+
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	// Value dependent prerequisites compare whole RRsets
+	for _, rrset := range required {
+		header := rrset[0].Header()
+		records := s.data[dns.CanonicalName(header.Name)][header.Rrtype]
+		if len(records) != len(rrset) { return dns.RcodeNXRrset }
+		for _, record := range records {
+			if !isDuplicateRR(rrset, record.Data) { return dns.RcodeNXRrset }
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+func (s *RecordStore) applyUpdate (changed *DynamicRecords, rr dns.RR, apex string) (int) {
+	// Applies a single update (RFC 2136, 3.4.2) to the dynamic records.
+	// Records from the configuration file can't be changed.
+	header := rr.Header()
+	name := dns.CanonicalName(header.Name)
+	header.Name = name
+
+	// The SOA, NS at the apex and DNSSEC records are managed by us
+	switch header.Rrtype {
+	case dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeNSEC3PARAM, dns.TypeDNSKEY:
+		log.Printf("Ignoring UPDATE for %s/%s\n", name, dns.TypeToString[header.Rrtype])
+		return dns.RcodeSuccess
+	case dns.TypeNS:
+		if name == apex {
+			log.Printf("Ignoring UPDATE for %s/%s\n", name, dns.TypeToString[header.Rrtype])
+			return dns.RcodeSuccess
+		}
+	case dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB:
+		return dns.RcodeFormatError
+	}
+
+	// Companion TXT records define the check of the name below
+	if header.Rrtype == dns.TypeTXT && strings.HasPrefix(name, checkLabel) {
+		owner := strings.TrimPrefix(name, checkLabel)
+		switch header.Class {
+		case dns.ClassINET:
+			spec := strings.Join(rr.(*dns.TXT).Txt, " ")
+			if rcode := validateCheck(spec); rcode != dns.RcodeSuccess { return rcode }
+			changed.Checks[owner] = spec
+		case dns.ClassANY, dns.ClassNONE:
+			delete(changed.Checks, owner)
+		}
+		return dns.RcodeSuccess
+	}
+
+	switch header.Class {
+	case dns.ClassINET:
+		// Add a record, unless it exists already or conflicts with a CNAME
+		if header.Rrtype == dns.TypeANY { return dns.RcodeFormatError }
+		if s.conflicts(changed, rr) {
+			log.Printf("Ignoring UPDATE for %s/%s, which conflicts with a CNAME\n", name, dns.TypeToString[header.Rrtype])
+			return dns.RcodeSuccess
+		}
+		changed.remove(func(existing dns.RR) bool { return dns.IsDuplicate(existing, rr) })
+		if !s.configured(rr) { changed.Records = append(changed.Records, rr.String()) }
+
+	case dns.ClassANY:
+		// Delete all records of the name, or an RRset
+		if header.Rdlength != 0 { return dns.RcodeFormatError }
+		changed.remove(func(existing dns.RR) bool {
+			return dns.CanonicalName(existing.Header().Name) == name &&
+			       (header.Rrtype == dns.TypeANY || existing.Header().Rrtype == header.Rrtype)
+		})
+
+	case dns.ClassNONE:
+		// Delete a single record
+		if header.Rrtype == dns.TypeANY { return dns.RcodeFormatError }
+		record := dns.Copy(rr)
+		record.Header().Class = dns.ClassINET
+		changed.remove(func(existing dns.RR) bool { return dns.IsDuplicate(existing, record) })
+
+	default:
+		return dns.RcodeFormatError
+	}
+
+	return dns.RcodeSuccess
+}
+
+func validateCheck (spec string) (int) {
+	// Commands can only be run by UPDATE if explicitly allowed
+	entry := ParseCheckSpec(spec)
+	if check, ok := entry["check"].(map[string]interface{}); ok && check["type"] == "exec" && !updateconf.AllowExec {
+		log.Printf("Refusing exec check from UPDATE: %s\n", spec)
+		return dns.RcodeRefused
+	}
+
+	// The check is built for an example record, to catch errors early
+	content, _ := json.Marshal(substitute(entry, &dns.A{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IPv4(192, 0, 2, 1)}))
+	entryconf, err := config.ParseJson(string(content))
+	if err == nil { _, err = NewProbe(entryconf) }
+	if err != nil {
+		log.Printf("Invalid check from UPDATE: %s: %s\n", spec, err)
+		return dns.RcodeFormatError
+	}
+	return dns.RcodeSuccess
+}
+
+func (d *DynamicRecords) remove (match func(dns.RR) bool) {
+	var kept []string
+	for _, text := range d.Records {
+		rr, err := dns.NewRR(text)
+		if err != nil || rr == nil || match(rr) { continue }
+		kept = append(kept, text)
+	}
+	d.Records = kept
+}
+
+func (s *RecordStore) configured (rr dns.RR) (bool) {
+	// Whether `rr` is part of the configuration file (or the zone)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, record := range s.data[dns.CanonicalName(rr.Header().Name)][rr.Header().Rrtype] {
+		if !record.Dynamic && dns.IsDuplicate(record.Data, rr) { return true }
+	}
+	return false
+}
+
+func (s *RecordStore) conflicts (changed *DynamicRecords, rr dns.RR) (bool) {
+	// CNAMEs can't coexist with other data (RFC 2136, 3.4.2.2)
+	name := dns.CanonicalName(rr.Header().Name)
+	types := make(map[uint16]bool)
+
+	s.mutex.RLock()
+	for qtype, records := range s.data[name] {
+		for _, record := range records {
+			if !record.Dynamic { types[qtype] = true }
+		}
+	}
+	s.mutex.RUnlock()
+
+	for _, text := range changed.Records {
+		existing, err := dns.NewRR(text)
+		if err == nil && existing != nil && existing.Header().Name == name { types[existing.Header().Rrtype] = true }
+	}
+
+	if rr.Header().Rrtype == dns.TypeCNAME {
+		for qtype := range types {
+			if qtype != dns.TypeCNAME { return true }
+		}
+		return false
+	}
+	return types[dns.TypeCNAME]
+}
+
+func isDuplicateRR (rrs []dns.RR, rr dns.RR) (bool) {
+	for _, existing := range rrs {
+		if dns.IsDuplicate(existing, rr) { return true }
+	}
+	return false
+}
@@ -0,0 +1,361 @@
+package main
+
+import "errors"
+import "log"
+import "net"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+import "github.com/miekg/dns"
+import config "github.com/olebedev/config"
+
+// Number of serial changes kept for IXFR, older serials get a full transfer
+const journalSize = 100
+
+// Number of records per message in outgoing zone transfers
+const transferChunk = 100
+
+// Changes within this time are announced with a single NOTIFY
+const notifyDelay = 2 * time.Second
+
+type zoneChange struct {
+	From		uint32
+	To		uint32
+	Removed		[]dns.RR
+	Added		[]dns.RR
+}
+
+type Zone struct {
+	Name		string
+	SOA		*dns.SOA
+	Record		*DynRR
+	Transfer	[]*net.IPNet
+	Notify		[]string
+	mutex		sync.Mutex
+	journal		[]zoneChange
+	notify		map[string]chan bool
+	stopped		bool
+}
+
+// The zone we are authoritative for (nil if not configured)
+var zone *Zone
+
+func LoadZone (cfg *config.Config) (*Zone, []dns.RR, error) {
+	// Reads the `zone` section and returns the zone and
+	// its static records (NS and glue)
+	name := cfg.UString("name")
+	if name == "" { return nil, nil, errors.New("No name defined for zone") }
+	name = dns.CanonicalName(name)
+
+	mname := cfg.UString("soa.mname")
+	if mname == "" { return nil, nil, errors.New("No primary name server (soa.mname) defined for zone") }
+
+	ttl := uint32(cfg.UInt("ttl", 3600))
+	header := func(rrtype uint16) (dns.RR_Header) {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+
+	// The initial serial is the current time, or follows the
+	// serial of the last run if that is ahead (see LoadState)
+	soa := &dns.SOA{Hdr: header(dns.TypeSOA),
+			Ns: dns.Fqdn(mname),
+			Mbox: dns.Fqdn(cfg.UString("soa.rname", "hostmaster." + name)),
+			Serial: uint32(time.Now().Unix()),
+			Refresh: uint32(cfg.UInt("soa.refresh", 3600)),
+			Retry: uint32(cfg.UInt("soa.retry", 600)),
+			Expire: uint32(cfg.UInt("soa.expire", 604800)),
+			Minttl: uint32(cfg.UInt("soa.minimum", 60))}
+
+	var records []dns.RR
+
+	// Without NS records, the primary is the only name server
+	nameservers := cfg.UList("ns", []interface{}{mname})
+	for _, ns := range nameservers {
+		target, ok := ns.(string)
+		if !ok { return nil, nil, errors.New("Invalid entry in ns list") }
+		records = append(records, &dns.NS{Hdr: header(dns.TypeNS), Ns: dns.Fqdn(target)})
+	}
+
+	// Glue is given as full records (e.g. "ns1.example.org 3600 IN A 192.0.2.1")
+	for _, glue := range cfg.UList("glue") {
+		text, _ := glue.(string)
+		rr, err := dns.NewRR(text)
+		if err != nil { return nil, nil, err }
+		if rr == nil || !dns.IsSubDomain(name, rr.Header().Name) {
+			return nil, nil, errors.New("Glue record outside of zone: " + text)
+		}
+		records = append(records, rr)
+	}
+
+	newzone := &Zone{Name: name, SOA: soa}
+
+	// Clients allowed to transfer the zone, as addresses or networks
+	for _, client := range cfg.UList("transfer") {
+		text, _ := client.(string)
+		if !strings.Contains(text, "/") {
+			if strings.Contains(text, ":") { text += "/128" } else { text += "/32" }
+		}
+		_, network, err := net.ParseCIDR(text)
+		if err != nil { return nil, nil, err }
+		newzone.Transfer = append(newzone.Transfer, network)
+	}
+
+	// Secondaries to notify about changes (host or host:port)
+	for _, target := range cfg.UList("notify") {
+		text, _ := target.(string)
+		if _, _, err := net.SplitHostPort(text); err != nil { text = net.JoinHostPort(text, "53") }
+		newzone.Notify = append(newzone.Notify, text)
+	}
+
+	return newzone, records, nil
+}
+
+func (z *Zone) Contains (name string) (bool) {
+	return dns.IsSubDomain(z.Name, dns.CanonicalName(name))
+}
+
+func (z *Zone) TransferAllowed (addr net.Addr) (bool) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil { return false }
+	ip := net.ParseIP(host)
+	for _, network := range z.Transfer {
+		if network.Contains(ip) { return true }
+	}
+	return false
+}
+
+func (z *Zone) Serial () (uint32) {
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	return z.SOA.Serial
+}
+
+func (z *Zone) Restore (saved uint32) {
+	// Continues after the serial saved by the last run, if ours is not
+	// ahead of it. Secondaries have none of our journal's serials then.
+	// Called with the record store locked, which protects `Record`.
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	if z.SOA.Serial > saved { return }
+
+	soa := dns.Copy(z.SOA).(*dns.SOA)
+	soa.Serial = saved + 1
+	z.SOA = soa
+	if z.Record != nil { z.Record.Data = soa }
+	z.journal = nil
+	log.Printf("Serial for %s continues at %d after the last run\n", z.Name, soa.Serial)
+}
+
+func (z *Zone) Bump (removed []dns.RR, added []dns.RR) {
+	// Increase the serial after the served data changed,
+	// record the change for IXFR and tell the secondaries.
+	// The SOA is replaced, as answers may still refer to the old one.
+	// Called with the record store locked, which protects `Record`.
+	z.mutex.Lock()
+	soa := dns.Copy(z.SOA).(*dns.SOA)
+	from := soa.Serial
+	soa.Serial++
+	to := soa.Serial
+	z.SOA = soa
+	if z.Record != nil { z.Record.Data = soa }
+
+	z.journal = append(z.journal, zoneChange{From: from, To: to, Removed: removed, Added: added})
+	if len(z.journal) > journalSize { z.journal = z.journal[len(z.journal)-journalSize:] }
+	z.queueNotify()
+	z.mutex.Unlock()
+
+	log.Printf("Serial for %s changed from %d to %d\n", z.Name, from, to)
+}
+
+func (z *Zone) queueNotify () {
+	// Called with the zone locked. Every secondary has its own sender
+	// with at most one pending NOTIFY, so a burst of changes (e.g. at
+	// startup) results in a few NOTIFYs instead of one per change.
+	if z.stopped { return }
+	if z.notify == nil { z.notify = make(map[string]chan bool) }
+	for _, target := range z.Notify {
+		queue, ok := z.notify[target]
+		if !ok {
+			queue = make(chan bool, 1)
+			z.notify[target] = queue
+			go z.notifyLoop(target, queue)
+		}
+		select {
+		case queue <- true:
+		default:
+		}
+	}
+}
+
+func (z *Zone) notifyLoop (target string, queue chan bool) {
+	for range queue {
+		// Changes until the NOTIFY is sent are covered by it
+		time.Sleep(notifyDelay)
+		select {
+		case <-queue:
+		default:
+		}
+		z.SendNotify(target)
+	}
+}
+
+func (z *Zone) StopNotify () {
+	// The senders exit after delivering pending notifications,
+	// e.g. after the zone was replaced by a reload
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	z.stopped = true
+	for _, queue := range z.notify { close(queue) }
+	z.notify = nil
+}
+
+func (z *Zone) SendNotify (target string) {
+	// Try a few times, secondaries may be busy or restarting
+	notify := new(dns.Msg)
+	notify.SetNotify(z.Name)
+
+	client := &dns.Client{Timeout: 5 * time.Second}
+	for attempt := 1; attempt <= 3; attempt++ {
+		response, _, err := client.Exchange(notify, target)
+		if err == nil && response.Rcode == dns.RcodeSuccess { return }
+		if err == nil { err = errors.New(dns.RcodeToString[response.Rcode]) }
+		log.Printf("NOTIFY for %s to %s failed (attempt %d): %s\n", z.Name, target, attempt, err)
+		time.Sleep(time.Duration(attempt) * 10 * time.Second)
+	}
+}
+
+func (z *Zone) NegativeSOA () (dns.RR) {
+	// The SOA for negative answers carries the negative caching
+	// TTL, which is the lower of its TTL and MINIMUM (RFC 2308, 3)
+	z.mutex.Lock()
+	soa := dns.Copy(z.SOA).(*dns.SOA)
+	z.mutex.Unlock()
+
+	if soa.Minttl < soa.Hdr.Ttl { soa.Hdr.Ttl = soa.Minttl }
+	return soa
+}
+
+func (z *Zone) AddAuthority (answer *dns.Msg, dnsdata map[string]map[uint16][]*DynRR) {
+	// Negative answers get the SOA, positive answers the NS set
+	if final, negative := negativeAnswer(answer, dnsdata); negative && z.Contains(final) {
+		answer.Ns = append(answer.Ns, z.NegativeSOA())
+		return
+	}
+
+	nameservers := servedRRs(dnsdata[z.Name][dns.TypeNS])
+	for _, rr := range answer.Answer {
+		// Don't repeat the NS set if it already is the answer
+		if rr.Header().Rrtype == dns.TypeNS && dns.CanonicalName(rr.Header().Name) == z.Name {
+			nameservers = nil
+			break
+		}
+	}
+	answer.Ns = append(answer.Ns, nameservers...)
+
+	// Add addresses for in-zone name servers to the additional section
+	for _, rr := range servedRRs(dnsdata[z.Name][dns.TypeNS]) {
+		target := dns.CanonicalName(rr.(*dns.NS).Ns)
+		if !z.Contains(target) { continue }
+		answer.Extra = append(answer.Extra, servedRRs(dnsdata[target][dns.TypeA])...)
+		answer.Extra = append(answer.Extra, servedRRs(dnsdata[target][dns.TypeAAAA])...)
+	}
+}
+
+func (z *Zone) TransferAnswer (query *dns.Msg, dnsdata map[string]map[uint16][]*DynRR) (*dns.Msg) {
+	// Builds the complete answer for an AXFR or IXFR query, which
+	// is split into multiple messages when it is sent out
+	answer := new(dns.Msg)
+	answer.SetReply(query)
+	answer.Authoritative = true
+
+	z.mutex.Lock()
+	defer z.mutex.Unlock()
+	soa := dns.Copy(z.SOA)
+
+	if query.Question[0].Qtype == dns.TypeIXFR && len(query.Ns) > 0 {
+		if clientsoa, ok := query.Ns[0].(*dns.SOA); ok {
+			// Client is up-to-date, the answer is just our SOA
+			if clientsoa.Serial == z.SOA.Serial {
+				answer.Answer = []dns.RR{soa}
+				return answer
+			}
+
+			// Send the differences, if the journal goes back far enough (RFC 1995, 4)
+			for i, change := range z.journal {
+				if change.From != clientsoa.Serial { continue }
+				answer.Answer = append(answer.Answer, soa)
+				for _, step := range z.journal[i:] {
+					oldsoa := dns.Copy(z.SOA).(*dns.SOA)
+					oldsoa.Serial = step.From
+					newsoa := dns.Copy(z.SOA).(*dns.SOA)
+					newsoa.Serial = step.To
+
+					answer.Answer = append(answer.Answer, oldsoa)
+					answer.Answer = append(answer.Answer, step.Removed...)
+					answer.Answer = append(answer.Answer, newsoa)
+					answer.Answer = append(answer.Answer, step.Added...)
+				}
+				answer.Answer = append(answer.Answer, soa)
+				return answer
+			}
+		}
+	}
+
+	// Full transfer: SOA, all served records, SOA
+	answer.Answer = append(answer.Answer, soa)
+	answer.Answer = append(answer.Answer, z.records(dnsdata)...)
+	answer.Answer = append(answer.Answer, soa)
+	return answer
+}
+
+func (z *Zone) records (dnsdata map[string]map[uint16][]*DynRR) ([]dns.RR) {
+	// All served records within the zone in a stable order. Signatures
+	// are created on the fly, so DNSSEC records are not transferred.
+	var names []string
+	for name := range dnsdata {
+		if z.Contains(name) { names = append(names, name) }
+	}
+	sort.Strings(names)
+
+	var result []dns.RR
+	for _, name := range names {
+		var types []int
+		for qtype := range dnsdata[name] { types = append(types, int(qtype)) }
+		sort.Ints(types)
+
+		for _, qtype := range types {
+			switch uint16(qtype) {
+			case dns.TypeSOA, dns.TypeDNSKEY, dns.TypeNSEC3PARAM:
+				continue
+			}
+			result = append(result, servedRRs(dnsdata[name][uint16(qtype)])...)
+		}
+	}
+
+	return result
+}
+
+func TransferOut (w dns.ResponseWriter, query *dns.Msg, response *dns.Msg) (error) {
+	// Write a transfer answer as a sequence of messages
+	envelopes := make(chan *dns.Envelope)
+	transfer := new(dns.Transfer)
+
+	done := make(chan error)
+	go func() { done <- transfer.Out(w, query, envelopes) }()
+
+	for start := 0; start < len(response.Answer); start += transferChunk {
+		end := start + transferChunk
+		if end > len(response.Answer) { end = len(response.Answer) }
+
+		// Stop early if the client went away
+		select {
+		case envelopes <- &dns.Envelope{RR: response.Answer[start:end]}:
+		case err := <-done:
+			return err
+		}
+	}
+	close(envelopes)
+
+	return <-done
+}
@@ -0,0 +1,58 @@
+package main
+
+import "bufio"
+import "fmt"
+import "log"
+import "net"
+import "os"
+import "strconv"
+import "strings"
+
+// Labels for autonomous systems, nil if not configured
+var asnmap map[uint]string
+
+func LoadASNMap (filename string) (map[uint]string, error) {
+  // Reads lines like "3320 dtag" or "as7922 comcast".
+  // Empty lines and lines starting with # are ignored.
+  file, err := os.Open(filename)
+  if err != nil { return nil, err }
+  defer file.Close()
+
+  result := make(map[uint]string)
+  scanner := bufio.NewScanner(file)
+  lineno := 0
+  for scanner.Scan() {
+    lineno++
+    line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+    if line == "" || strings.HasPrefix(line, "#") { continue }
+
+    fields := strings.Fields(line)
+    if len(fields) != 2 || !validlabel.MatchString(fields[1]) {
+      return nil, fmt.Errorf("%s:%d: expected \"asn label\"", filename, lineno)
+    }
+
+    asn, err := strconv.ParseUint(strings.TrimPrefix(fields[0], "as"), 10, 32)
+    if err != nil || asn == 0 { return nil, fmt.Errorf("%s:%d: invalid ASN %s", filename, lineno, fields[0]) }
+    if other, ok := result[uint(asn)]; ok {
+      return nil, fmt.Errorf("%s:%d: AS%d is already mapped to %s", filename, lineno, asn, other)
+    }
+    result[uint(asn)] = fields[1]
+  }
+  if err := scanner.Err(); err != nil { return nil, err }
+
+  return result, nil
+}
+
+func get_ip_asn (ip net.IP) (uint, string) {
+  // Lookup the IP address in the ASN database (if any), returns the
+  // ASN and its label: "as<ASN>" or, with asn=map, the mapped label
+  reader := asndb.Load()
+  if reader == nil { return 0, `` }
+  record, err := reader.ASN(ip)
+  if err != nil { log.Printf("ASN lookup failed for %s: %s\n", ip, err.Error()); return 0, `` }
+
+  asn := record.AutonomousSystemNumber
+  if asn == 0 { return 0, `` }
+  if rewrite["asn"] == "map" { return asn, asnmap[asn] }
+  return asn, "as" + strconv.FormatUint(uint64(asn), 10)
+}
@@ -0,0 +1,90 @@
+package main
+
+import "errors"
+import "fmt"
+import "log"
+import "net"
+import "strings"
+import "sync/atomic"
+import "time"
+import "github.com/miekg/dns"
+
+type Backend struct {
+  // An upstream server, which is down if its last probe failed
+  Address string
+  Timeout time.Duration
+  healthy atomic.Bool
+}
+
+// All backends in the configured order
+var backends []*Backend
+
+// "failover" or "roundrobin"
+var balance string
+
+// Position for round robin
+var nextbackend atomic.Uint64
+
+func ParseBackend (spec string, timeout time.Duration) (*Backend, error) {
+  // "192.0.2.10", "192.0.2.10:5353" or "[2001:db8::53]:53,500ms"
+  address, custom, found := strings.Cut(spec, ",")
+  if found {
+    var err error
+    timeout, err = time.ParseDuration(custom)
+    if err != nil { return nil, fmt.Errorf("Invalid timeout for backend %s: %s", address, err) }
+  }
+
+  // Backend needs to contain a port number (default :53)
+  if _, _, err := net.SplitHostPort(address); err != nil { address = net.JoinHostPort(strings.Trim(address, "[]"), "53") }
+
+  backend := &Backend{Address: address, Timeout: timeout}
+  backend.healthy.Store(true)
+  return backend, nil
+}
+
+func (b *Backend) Exchange (q *dns.Msg) (*dns.Msg, error) {
+  client := &dns.Client{Net: "udp", Timeout: b.Timeout}
+  in, _, err := client.Exchange(q, b.Address)
+
+  // Truncated responses are repeated over TCP
+  if err == nil && in.Truncated {
+    client.Net = "tcp"
+    in, _, err = client.Exchange(q, b.Address)
+  }
+  return in, err
+}
+
+func (b *Backend) Probe (name string, interval time.Duration) {
+  // Any response means the backend is up, even an error
+  q := new(dns.Msg)
+  q.SetQuestion(dns.Fqdn(name), dns.TypeSOA)
+  for range time.Tick(interval) {
+    _, err := b.Exchange(q)
+    healthy := err == nil
+    if b.healthy.Swap(healthy) != healthy {
+      if healthy { log.Printf("Backend %s is up\n", b.Address) } else { log.Printf("Backend %s is down: %s\n", b.Address, err) }
+    }
+  }
+}
+
+func backend_exchange (q *dns.Msg) (*dns.Msg, error) {
+  // Tries the healthy backends, starting with the first one (failover)
+  // or the next one (roundrobin), until one answers
+  start := 0
+  if balance == "roundrobin" { start = int(nextbackend.Add(1) % uint64(len(backends))) }
+
+  var lasterr error = errors.New("No backend available")
+  for i := range backends {
+    backend := backends[(start + i) % len(backends)]
+    if !backend.healthy.Load() { continue }
+
+    start := time.Now()
+    in, err := backend.Exchange(q)
+    observe_backend(backend.Address, start, err)
+    if err == nil { return in, nil }
+    if debug { log.Printf("Backend %s failed: %s\n", backend.Address, err) }
+    lasterr = err
+  }
+
+  return nil, lasterr
+}
@@ -0,0 +1,169 @@
+package main
+
+import "container/list"
+import "log"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+import "github.com/miekg/dns"
+
+type cacheEntry struct {
+  key string
+  msg *dns.Msg
+  stored time.Time
+  expires time.Time
+}
+
+type Cache struct {
+  // Backend responses by (rewritten) qname, qtype and DO bit. The least
+  // recently used entry is dropped when the cache is full.
+  mutex sync.Mutex
+  size int
+  entries map[string]*list.Element
+  order *list.List
+  hits uint64
+  misses uint64
+}
+
+// Global cache, nil if disabled
+var cache *Cache
+
+func NewCache (size int) (*Cache) {
+  return &Cache{size: size, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func cache_key (q *dns.Msg) (string) {
+  // Responses with DNSSEC records are only given to clients which asked
+  // for them, responses with OPT (and their size) only to EDNS clients
+  // (RFC 6891, 7)
+  edns := "none"
+  if opt := q.IsEdns0(); opt != nil { edns = strconv.Itoa(int(opt.UDPSize())) + "/" + strconv.FormatBool(opt.Do()) }
+  return strings.ToLower(q.Question[0].Name) + "/" + strconv.Itoa(int(q.Question[0].Qtype)) + "/" + edns
+}
+
+func (c *Cache) Get (q *dns.Msg) (*dns.Msg) {
+  // Returns a copy of the cached response with TTLs reduced by its age
+  if c == nil { return nil }
+  key := cache_key(q)
+
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+
+  element, ok := c.entries[key]
+  if !ok { c.misses++; return nil }
+
+  entry := element.Value.(*cacheEntry)
+  now := time.Now()
+  if !now.Before(entry.expires) {
+    c.order.Remove(element)
+    delete(c.entries, key)
+    c.misses++
+    return nil
+  }
+
+  c.order.MoveToFront(element)
+  c.hits++
+
+  msg := entry.msg.Copy()
+  age := uint32(now.Sub(entry.stored).Seconds())
+  for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+    for _, rr := range section {
+      // The TTL of OPT holds flags, not a time
+      if rr.Header().Rrtype == dns.TypeOPT { continue }
+      if rr.Header().Ttl > age { rr.Header().Ttl -= age } else { rr.Header().Ttl = 0 }
+    }
+  }
+  return msg
+}
+
+func (c *Cache) Put (q *dns.Msg, msg *dns.Msg) {
+  if c == nil { return }
+  ttl, ok := cache_ttl(msg)
+  if !ok || ttl == 0 { return }
+
+  now := time.Now()
+  key := cache_key(q)
+  entry := &cacheEntry{key: key, msg: msg.Copy(), stored: now, expires: now.Add(ttl)}
+
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+
+  if element, ok := c.entries[key]; ok {
+    element.Value = entry
+    c.order.MoveToFront(element)
+    return
+  }
+  c.entries[key] = c.order.PushFront(entry)
+
+  // Make room by dropping the least recently used entries
+  for c.order.Len() > c.size {
+    oldest := c.order.Back()
+    c.order.Remove(oldest)
+    delete(c.entries, oldest.Value.(*cacheEntry).key)
+  }
+}
+
+func cache_ttl (msg *dns.Msg) (time.Duration, bool) {
+  // How long a response may be cached: the lowest TTL of its records
+  // or, for negative answers, the SOA minimum (RFC 2308, 5). Errors,
+  // truncated responses and negative answers without SOA are not cached.
+  if msg.Truncated { return 0, false }
+
+  negative := msg.Rcode == dns.RcodeNameError || (msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0)
+  if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError { return 0, false }
+
+  var ttl uint32
+  found := false
+  lower := func(value uint32) {
+    if !found || value < ttl { ttl = value }
+    found = true
+  }
+
+  if negative {
+    for _, rr := range msg.Ns {
+      if soa, ok := rr.(*dns.SOA); ok {
+        lower(soa.Hdr.Ttl)
+        lower(soa.Minttl)
+      }
+    }
+    if !found { return 0, false }
+    return time.Duration(ttl) * time.Second, true
+  }
+
+  for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+    for _, rr := range section {
+      if rr.Header().Rrtype != dns.TypeOPT { lower(rr.Header().Ttl) }
+    }
+  }
+  return time.Duration(ttl) * time.Second, found
+}
+
+func (c *Cache) Stats () (int, uint64, uint64) {
+  // Number of entries, hits and misses
+  c.mutex.Lock()
+  defer c.mutex.Unlock()
+  return c.order.Len(), c.hits, c.misses
+}
+
+func (c *Cache) LogStats (interval time.Duration) {
+  // Log the hit rate regularly
+  for range time.Tick(interval) {
+    entries, hits, misses := c.Stats()
+    rate := 0.0
+    if hits + misses > 0 { rate = float64(hits) * 100 / float64(hits + misses) }
+    log.Printf("Cache: %d entries, %d hits, %d misses (%.1f%% hit rate)\n", entries, hits, misses, rate)
+  }
+}
+
+func exchange (q *dns.Msg) (*dns.Msg, error) {
+  // Answer from the cache if possible, otherwise ask the backend
+  if cached := cache.Get(q); cached != nil {
+    if debug { log.Printf("Cache hit for %s/%s\n", q.Question[0].Name, dns.TypeToString[q.Question[0].Qtype]) }
+    return cached, nil
+  }
+
+  in, err := backend_exchange(q)
+  if err == nil { cache.Put(q, in) }
+  return in, err
+}
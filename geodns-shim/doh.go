@@ -0,0 +1,151 @@
+package main
+
+import "crypto/tls"
+import "encoding/base64"
+import "fmt"
+import "io"
+import "log"
+import "net"
+import "net/http"
+import "strings"
+import "time"
+import "github.com/miekg/dns"
+
+// Proxies which are trusted to set X-Forwarded-For for DoH
+var trustedproxies []*net.IPNet
+
+type dohWriter struct {
+  // Passes the response of handleDnsRequest to the HTTP client
+  response http.ResponseWriter
+  local net.Addr
+  remote net.Addr
+}
+
+func (w *dohWriter) LocalAddr () (net.Addr) { return w.local }
+func (w *dohWriter) RemoteAddr () (net.Addr) { return w.remote }
+func (w *dohWriter) Close () (error) { return nil }
+func (w *dohWriter) TsigStatus () (error) { return nil }
+func (w *dohWriter) TsigTimersOnly (bool) {}
+func (w *dohWriter) Hijack () {}
+
+func (w *dohWriter) WriteMsg (msg *dns.Msg) (error) {
+  packed, err := msg.Pack()
+  if err != nil { return err }
+
+  // HTTP caches may keep the response as long as a resolver would (RFC 8484, 5.1).
+  // Without a client subnet in the query (and so in the URL of GET requests),
+  // the answer depends on the client address, so only the client may cache it.
+  if ttl, ok := cache_ttl(msg); ok {
+    scope := "private, "
+    if has_client_subnet(msg) { scope = "" }
+    w.response.Header().Set("Cache-Control", fmt.Sprintf("%smax-age=%d", scope, int(ttl.Seconds())))
+  }
+  _, err = w.Write(packed)
+  return err
+}
+
+func has_client_subnet (msg *dns.Msg) (bool) {
+  if opt := msg.IsEdns0(); opt != nil {
+    for _, option := range opt.Option {
+      if option.Option() == dns.EDNS0SUBNET { return true }
+    }
+  }
+  return false
+}
+
+func (w *dohWriter) Write (packed []byte) (int, error) {
+  w.response.Header().Set("Content-Type", "application/dns-message")
+  return w.response.Write(packed)
+}
+
+func ParseTrustedProxies (specs []string) ([]*net.IPNet, error) {
+  // Networks or single addresses
+  var result []*net.IPNet
+  for _, spec := range specs {
+    cidr := spec
+    if !strings.Contains(cidr, "/") {
+      if strings.Contains(cidr, ":") { cidr += "/128" } else { cidr += "/32" }
+    }
+    _, network, err := net.ParseCIDR(cidr)
+    if err != nil { return nil, fmt.Errorf("Invalid trusted proxy %s: %s", spec, err) }
+    result = append(result, network)
+  }
+  return result, nil
+}
+
+func trusted_proxy (ip net.IP) (bool) {
+  for _, network := range trustedproxies {
+    if network.Contains(ip) { return true }
+  }
+  return false
+}
+
+func doh_client_address (req *http.Request) (net.IP) {
+  // The address of the connection, unless it is one of our proxies. Then
+  // the last address in X-Forwarded-For which was not added by one of our
+  // proxies is used, as anything before it can be set by the client.
+  host, _, _ := net.SplitHostPort(req.RemoteAddr)
+  ip := net.ParseIP(host)
+  if !trusted_proxy(ip) { return ip }
+
+  var hops []string
+  for _, header := range req.Header.Values("X-Forwarded-For") { hops = append(hops, strings.Split(header, ",")...) }
+  for i := len(hops) - 1; i >= 0; i-- {
+    hop := net.ParseIP(strings.TrimSpace(hops[i]))
+    if hop == nil { break }
+    ip = hop
+    if !trusted_proxy(ip) { break }
+  }
+  return ip
+}
+
+func handle_doh (response http.ResponseWriter, req *http.Request) {
+  // RFC 8484: the query is base64url encoded in the "dns" parameter (GET)
+  // or the body (POST)
+  var packed []byte
+  var err error
+  switch req.Method {
+    case http.MethodGet:
+      packed, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(req.URL.Query().Get("dns"), "="))
+    case http.MethodPost:
+      if req.Header.Get("Content-Type") != "application/dns-message" {
+        http.Error(response, "Expected application/dns-message", http.StatusUnsupportedMediaType)
+        return
+      }
+      packed, err = io.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize))
+    default:
+      response.Header().Set("Allow", "GET, POST")
+      http.Error(response, "Method not allowed", http.StatusMethodNotAllowed)
+      return
+  }
+  if err != nil || len(packed) == 0 {
+    http.Error(response, "Missing or invalid DNS query", http.StatusBadRequest)
+    return
+  }
+
+  query := new(dns.Msg)
+  if err := query.Unpack(packed); err != nil || query.Response {
+    http.Error(response, "Missing or invalid DNS query", http.StatusBadRequest)
+    return
+  }
+
+  local, _ := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+  writer := &dohWriter{response: response, local: local, remote: &net.TCPAddr{IP: doh_client_address(req)}}
+  handleDnsRequest(writer, query)
+}
+
+func ServeDoH (addr string, path string, config *tls.Config) {
+  // Without a certificate, DoH is served over plain HTTP (for use
+  // behind a reverse proxy which terminates TLS)
+  mux := http.NewServeMux()
+  mux.HandleFunc(path, handle_doh)
+  server := &http.Server{Addr: addr, Handler: mux, TLSConfig: config,
+                         ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second, IdleTimeout: 2 * time.Minute}
+
+  log.Printf("DoH listening on %s%s\n", addr, path)
+  if config != nil {
+    log.Println(server.ListenAndServeTLS("", ""))
+  } else {
+    log.Println(server.ListenAndServe())
+  }
+}
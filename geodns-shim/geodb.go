@@ -0,0 +1,84 @@
+package main
+
+import "fmt"
+import "log"
+import "net"
+import "os"
+import "sync/atomic"
+import "time"
+import "github.com/oschwald/geoip2-golang"
+
+// Current GeoIP and ASN databases, replaced on reload. Queries
+// which still use the previous one can finish with it.
+var geodb atomic.Pointer[geoip2.Reader]
+var asndb atomic.Pointer[geoip2.Reader]
+
+func read_mmdb (filename string) (*geoip2.Reader, error) {
+  // The database is read into memory instead of mapping the file,
+  // so it can't change under us if the file is overwritten in place
+  content, err := os.ReadFile(filename)
+  if err != nil { return nil, err }
+  reader, err := geoip2.FromBytes(content)
+  if err != nil { return nil, fmt.Errorf("%s: %s", filename, err) }
+  return reader, nil
+}
+
+func LoadGeoDB (filename string) (*geoip2.Reader, error) {
+  reader, err := read_mmdb(filename)
+  if err != nil { return nil, err }
+
+  // We need a database which can do City lookups
+  if _, err := reader.City(net.IPv4(127, 0, 0, 1)); err != nil { return nil, fmt.Errorf("%s: %s", filename, err) }
+
+  metadata := reader.Metadata()
+  log.Printf("Loaded GeoIP database %s (%s, built %s)\n", filename, metadata.DatabaseType,
+             time.Unix(int64(metadata.BuildEpoch), 0).UTC().Format(time.RFC3339))
+  return reader, nil
+}
+
+func LoadASNDB (filename string) (*geoip2.Reader, error) {
+  reader, err := read_mmdb(filename)
+  if err != nil { return nil, err }
+
+  // We need a database which can do ASN lookups (e.g. GeoLite2-ASN)
+  if _, err := reader.ASN(net.IPv4(127, 0, 0, 1)); err != nil { return nil, fmt.Errorf("%s: %s", filename, err) }
+
+  metadata := reader.Metadata()
+  log.Printf("Loaded ASN database %s (%s, built %s)\n", filename, metadata.DatabaseType,
+             time.Unix(int64(metadata.BuildEpoch), 0).UTC().Format(time.RFC3339))
+  return reader, nil
+}
+
+func reload_geodb (filename string) {
+  // Errors keep the current database
+  reader, err := LoadGeoDB(filename)
+  if err != nil {
+    log.Printf("Could not reload GeoIP database: %s\n", err)
+    return
+  }
+  geodb.Store(reader)
+}
+
+func reload_asndb (filename string) {
+  // Errors keep the current database
+  reader, err := LoadASNDB(filename)
+  if err != nil {
+    log.Printf("Could not reload ASN database: %s\n", err)
+    return
+  }
+  asndb.Store(reader)
+}
+
+func watch_geodb (filename string, interval time.Duration, reload func(string)) {
+  // Reload when the modification time of the file changes, e.g.
+  // after geoipupdate replaced it
+  var modtime time.Time
+  if info, err := os.Stat(filename); err == nil { modtime = info.ModTime() }
+
+  for range time.Tick(interval) {
+    info, err := os.Stat(filename)
+    if err != nil || info.ModTime().Equal(modtime) { continue }
+    modtime = info.ModTime()
+    reload(filename)
+  }
+}
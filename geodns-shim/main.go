@@ -1,19 +1,19 @@
 package main
 
+import "crypto/tls"
 import "fmt"
 import "log"
 import "net"
 import "os"
-import "regexp"
+import "os/signal"
 import "strconv"
 import "strings"
+import "syscall"
+import "time"
 import "github.com/miekg/dns"
-import "github.com/oschwald/geoip2-golang"
 import "github.com/DavidGamba/go-getoptions"
 
 // Global variables, used in the DNS handling function
-var geodb *geoip2.Reader
-var dnsbackend string
 var nxfallback bool
 var debug bool
 var rewrite map[string]string
@@ -23,14 +23,51 @@ func main() {
   var listen string
   var dnsport string
   var geodbfile string
+  var asndbfile string
+  var asnmapfile string
+  var cachesize int
+  var regionsfile string
+  var overridesfile string
+  var backendlist []string
+  var timeout string
+  var probename string
+  var probeinterval int
+  var watch int
+  var metricslisten string
+  var querylogfile string
+  var tlsport string
+  var dohport string
+  var dohpath string
+  var certfile string
+  var keyfile string
+  var proxylist []string
   opt := getoptions.New()
   opt.StringVar(&geodbfile, "geodb", "", opt.Required())
-  opt.StringVar(&dnsbackend, "backend", "", opt.Required())
+  opt.StringVar(&asndbfile, "asndb", "")
+  opt.StringVar(&asnmapfile, "asnmap", "")
+  opt.StringSliceVar(&backendlist, "backend", 1, 99, opt.Required())
+  opt.StringVar(&balance, "balance", "failover")
+  opt.StringVar(&timeout, "timeout", "2s")
+  opt.StringVar(&probename, "probe", ".")
+  opt.IntVar(&probeinterval, "probeinterval", 5)
+  opt.IntVar(&watch, "watch", 0)
+  opt.StringVar(&metricslisten, "metrics", "")
+  opt.StringVar(&querylogfile, "querylog", "")
   opt.StringVar(&listen, "listen", "127.0.0.1")
   opt.StringVar(&dnsport, "port", "53")
+  opt.StringVar(&tlsport, "tlsport", "")
+  opt.StringVar(&dohport, "dohport", "")
+  opt.StringVar(&dohpath, "dohpath", "/dns-query")
+  opt.StringVar(&certfile, "cert", "")
+  opt.StringVar(&keyfile, "key", "")
+  opt.StringSliceVar(&proxylist, "trustproxy", 1, 99)
   opt.BoolVar(&nxfallback, "nxfallback", false)
   opt.BoolVar(&debug, "debug", false)
-  opt.StringMapVar(&rewrite, "rewrite", 2, 3, opt.Required())
+  opt.IntVar(&cachesize, "cachesize", 10000)
+  opt.StringVar(&regionsfile, "regions", "")
+  opt.StringVar(&defaultlabel, "default", "")
+  opt.StringVar(&overridesfile, "overrides", "")
+  opt.StringMapVar(&rewrite, "rewrite", 2, 4, opt.Required())
 
   // Parse parameters
   remaining, err := opt.Parse(os.Args[1:])
@@ -50,12 +87,131 @@ func main() {
     os.Exit(1)
   }
 
-  // Backend needs to contain a port number (default :53)
-  hasport, _ := regexp.MatchString(`:`, dnsbackend)
-  if !hasport { dnsbackend = dnsbackend + `:53` }
+  // Set up the backends, which are probed in the background
+  if balance != "failover" && balance != "roundrobin" {
+    fmt.Printf("Unsupported balance mode: %s\n", balance)
+    os.Exit(1)
+  }
+  defaulttimeout, err := time.ParseDuration(timeout)
+  if err != nil {
+    fmt.Printf("Invalid timeout: %s\n", err)
+    os.Exit(1)
+  }
+  for _, spec := range backendlist {
+    backend, err := ParseBackend(spec, defaulttimeout)
+    if err != nil {
+      fmt.Println(err)
+      os.Exit(1)
+    }
+    backends = append(backends, backend)
+    go backend.Probe(probename, time.Duration(probeinterval) * time.Second)
+  }
+
+  // Open GeoIP database, which is reloaded on SIGHUP (or when it changes)
+  reader, err := LoadGeoDB(geodbfile)
+  if err != nil {
+    fmt.Printf("Could not open GeoIP database: %s\n", err)
+    os.Exit(1)
+  }
+  geodb.Store(reader)
+  if watch > 0 { go watch_geodb(geodbfile, time.Duration(watch) * time.Second, reload_geodb) }
+
+  // The ASN database is optional and handled like the GeoIP database.
+  // Clients are steered by "as<ASN>" labels or the labels of the map.
+  switch rewrite["asn"] {
+    case "", "number":
+    case "map":
+      if asnmapfile == "" {
+        fmt.Println("Rewrite asn=map requires asnmap")
+        os.Exit(1)
+      }
+    default:
+      fmt.Printf("Unsupported asn rewrite: %s\n", rewrite["asn"])
+      os.Exit(1)
+  }
+  if rewrite["asn"] != "" && asndbfile == "" {
+    fmt.Println("Rewrite asn requires asndb")
+    os.Exit(1)
+  }
+  if asndbfile != "" {
+    reader, err := LoadASNDB(asndbfile)
+    if err != nil {
+      fmt.Printf("Could not open ASN database: %s\n", err)
+      os.Exit(1)
+    }
+    asndb.Store(reader)
+    if watch > 0 { go watch_geodb(asndbfile, time.Duration(watch) * time.Second, reload_asndb) }
+  }
+  if asnmapfile != "" {
+    asnmap, err = LoadASNMap(asnmapfile)
+    if err != nil {
+      fmt.Printf("Could not load ASN map: %s\n", err)
+      os.Exit(1)
+    }
+  }
+
+  // Load our own regions, if configured
+  if regionsfile != "" {
+    regions, err = LoadRegions(regionsfile)
+    if err != nil {
+      fmt.Printf("Could not load regions: %s\n", err)
+      os.Exit(1)
+    }
+  }
+
+  // Load the overrides, which are reloaded on SIGHUP as well
+  if overridesfile != "" {
+    loaded, err := LoadOverrides(overridesfile)
+    if err != nil {
+      fmt.Printf("Could not load overrides: %s\n", err)
+      os.Exit(1)
+    }
+    overrides.Store(loaded)
+  }
+
+  // Load the certificate for DoT and DoH, which is reloaded on SIGHUP too
+  if (certfile == "") != (keyfile == "") {
+    fmt.Println("Both cert and key are required")
+    os.Exit(1)
+  }
+  if tlsport != "" && certfile == "" {
+    fmt.Println("DNS over TLS requires cert and key")
+    os.Exit(1)
+  }
+  var tlsconfig *tls.Config
+  if certfile != "" {
+    cert, err := LoadCertificate(certfile, keyfile)
+    if err != nil {
+      fmt.Printf("Could not load certificate: %s\n", err)
+      os.Exit(1)
+    }
+    certificate.Store(cert)
+    tlsconfig = tls_config()
+  }
+  trustedproxies, err = ParseTrustedProxies(proxylist)
+  if err != nil {
+    fmt.Println(err)
+    os.Exit(1)
+  }
+  go reload_on_signal(geodbfile, asndbfile, overridesfile, certfile, keyfile)
 
-  // Open GeoIP database
-  geodb, _ = geoip2.Open(geodbfile)
+  // Cache backend responses, unless disabled with size 0
+  if cachesize > 0 {
+    cache = NewCache(cachesize)
+    go cache.LogStats(5 * time.Minute)
+  }
+
+  // Write queries as JSON lines, if configured
+  if querylogfile != "" {
+    if err := OpenQueryLog(querylogfile); err != nil {
+      fmt.Printf("Could not open query log: %s\n", err)
+      os.Exit(1)
+    }
+  }
+
+  // Prometheus metrics are always collected, but only served if configured
+  RegisterMetrics()
+  if metricslisten != "" { go ServeMetrics(metricslisten) }
 
   // Register DNS handler
   dns.HandleFunc(".", handleDnsRequest)
@@ -68,21 +224,64 @@ func main() {
   go func(){ _ = udpserver.ListenAndServe() }()
   go func(){ _ = tcpserver.ListenAndServe() }()
 
+  // DNS over TLS (RFC 7858) and HTTPS (RFC 8484), if configured
+  if tlsport != "" {
+    tlsserver := &dns.Server{Addr: listen + `:` + tlsport, Net: "tcp-tls", TLSConfig: tlsconfig}
+    go func(){ log.Println(tlsserver.ListenAndServe()) }()
+  }
+  if dohport != "" { go ServeDoH(listen + `:` + dohport, dohpath, tlsconfig) }
+
   // Don't exit
   select {}
 }
 
+func reload_on_signal (geodbfile string, asndbfile string, overridesfile string, certfile string, keyfile string) {
+  hup := make(chan os.Signal, 1)
+  signal.Notify(hup, syscall.SIGHUP)
+  for range hup {
+    reload_geodb(geodbfile)
+    if asndbfile != "" { reload_asndb(asndbfile) }
+    if overridesfile != "" { reload_overrides(overridesfile) }
+    if certfile != "" { reload_certificate(certfile, keyfile) }
+  }
+}
+
 func handleDnsRequest (w dns.ResponseWriter, r *dns.Msg) {
-  // Catch classes other than IN
-  if r.Question[0].Qclass != dns.ClassINET {
-    answer := new(dns.Msg)
-    answer.SetRcode(r, dns.StringToRcode["NOTIMP"])
-    werr := w.WriteMsg(answer)
-    if werr != nil { log.Println(werr) }
+  start := time.Now()
+
+  // Details for the query log and metrics
+  host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+  entry := &QueryLog{Client: host}
+
+  // Queries need exactly one question
+  if len(r.Question) != 1 {
+    reply_error(w, r, dns.RcodeFormatError, entry, start)
+    return
   }
+  entry.Name, entry.Type = r.Question[0].Name, dns.Type(r.Question[0].Qtype).String()
 
-  // Use Client IP to get location (as ISO code)
-  isocode := get_ip_location(w.RemoteAddr().String())
+  // Catch other opcodes (e.g. NOTIFY) and classes other than IN
+  if r.Opcode != dns.OpcodeQuery || r.Question[0].Qclass != dns.ClassINET {
+    reply_error(w, r, dns.RcodeNotImplemented, entry, start)
+    return
+  }
+
+  // Use the client subnet (ECS) sent by the resolver or else
+  // the client IP to get location (as ISO code) and network (ASN)
+  // (unless there is an override for the address)
+  clientip, subnet := get_client_address(w, r)
+  network, label := overrides.Load().Lookup(clientip)
+  isocode, continent := label, ""
+  var asn uint
+  var asnlabel string
+  if network == nil {
+    isocode, continent = get_ip_location(clientip)
+    asn, asnlabel = get_ip_asn(clientip)
+  }
+
+  entry.Country, entry.ASN = isocode, asn
+  if subnet != nil { entry.Subnet = fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask) }
+  if network != nil { entry.Country, entry.Override = "", label }
 
   // Store the client's Query ID for later use in the answer
   var queryid = r.Id
@@ -95,45 +294,161 @@ func handleDnsRequest (w dns.ResponseWriter, r *dns.Msg) {
                                                 dns.TypeToString[r.Question[0].Qtype],
 						w.RemoteAddr().String(),
 						isocode)
+    if subnet != nil { log.Printf("Using client subnet %s/%d\n", subnet.Address, subnet.SourceNetmask) }
+    if network != nil { log.Printf("Override %s for %s: %s\n", network, clientip, label) }
+    if asn != 0 { log.Printf("AS%d for %s: %s\n", asn, clientip, asnlabel) }
   }
 
-  // Transform the query
-  posint, _ := strconv.Atoi(rewrite["pos"])
-  var newqname string
-  switch rewrite["mode"] {
-    case "add":
-      newqname = add_label(qname, isocode, posint)
-    case "suffix":
-      newqname = expand_label(qname, rewrite["sep"] + isocode, true, posint)
-    case "prefix":
-      newqname = expand_label(qname, isocode + rewrite["sep"], false, posint)
-    default:
-      newqname = add_label(qname, isocode, 1)
+  // Try the transformed names for the network, country, region, continent
+  // and the default until the backend has data for one of them. Queries are
+  // sent with the client's type, flags (RD, CD) and EDNS options (e.g. DO).
+  var in *dns.Msg
+  var newqname, pool string
+  for _, label := range location_chain(asnlabel, isocode, continent) {
+    name := rewrite_name(qname, label)
+    if debug { log.Printf("Rewriting %s -> %s\n", qname, name) }
+
+    newq := forward_query(r)
+    newq.Question[0].Name = name
+    response, _ := exchange(newq)
+
+    // Without data anywhere, the first response is used
+    if in == nil { in, newqname, pool = response, name, label }
+    if has_data(response) {
+      in, newqname, pool = response, name, label
+      break
+    }
+    if debug { log.Printf("No data for %s\n", name) }
   }
-  if debug { log.Printf("Rewriting %s -> %s\n", qname, newqname) }
 
-  // Send a query for the transformed name to the backend
-  var newq dns.Msg
-  newq.Question = make([]dns.Question, 1)
-  newq.Question[0] = dns.Question{Name: newqname, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+  if in == nil || (nxfallback && in.Rcode == 3) {
+    // Without a location (or a response), the original name is used
+    if in != nil && debug { log.Printf("Got NXDOMAIN for %s, resending with original qname %s\n", newqname, qname) }
+    if response, _ := exchange(forward_query(r)); response != nil { in, newqname, pool = response, qname, "" }
+  }
 
-  in, _ := dns.Exchange(&newq, dnsbackend)
-  if nxfallback && in.Rcode == 3 {
-    if debug { log.Printf("Got NXDOMAIN for %s, resending with original qname %s\n", newqname, qname) }
-    in, _ = dns.Exchange(r, dnsbackend)
+  // No backend answered
+  if in == nil {
+    log.Printf("No response from any backend for %s\n", qname)
+    reply_error(w, r, dns.RcodeServerFailure, entry, start)
+    return
   }
   in.Question = r.Question
 
   // Put the original Query ID into the answer we got from the server
   in.Id = queryid
-  for i, answer := range in.Answer {
-    // Rewrite the answer we got from the backend to fit the client's original query
-    in.Answer[i], _ = dns.NewRR(strings.Replace(answer.String(), newqname, qname, -1))
+
+  // Rewrite the answer we got from the backend to fit the client's original query
+  in.Answer = rewrite_section(in.Answer, newqname, qname)
+  in.Ns = rewrite_section(in.Ns, newqname, qname)
+  in.Extra = rewrite_section(in.Extra, newqname, qname)
+
+  // Tell the resolver which clients the answer is valid for
+  if subnet != nil { set_client_subnet(in, subnet) }
+
+  // Backend responses may have been fetched over TCP, so UDP clients
+  // get at most what they can take: 512 bytes or their EDNS buffer size
+  if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+    size := dns.MinMsgSize
+    if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size { size = int(opt.UDPSize()) }
+    in.Truncate(size)
   }
 
   // Send it!
   werr := w.WriteMsg(in)
   if werr != nil { log.Println(werr) }
+
+  if newqname != qname { entry.Rewritten = newqname }
+  entry.Rcode = rcode_name(in.Rcode)
+  // "as<ASN>" labels would give a metric series per ASN
+  if pool != "" && pool == asnlabel && rewrite["asn"] != "map" { pool = "network" }
+  record_query(entry, pool, start)
+}
+
+func reply_error (w dns.ResponseWriter, r *dns.Msg, rcode int, entry *QueryLog, start time.Time) {
+  // Answer with an error code only
+  answer := new(dns.Msg)
+  answer.SetRcode(r, rcode)
+  werr := w.WriteMsg(answer)
+  if werr != nil { log.Println(werr) }
+
+  entry.Rcode = rcode_name(rcode)
+  record_query(entry, "", start)
+}
+
+func rewrite_name (qname string, label string) (string) {
+  // Transform the query name according to the rewrite rules
+  posint, _ := strconv.Atoi(rewrite["pos"])
+  switch rewrite["mode"] {
+    case "add":
+      return add_label(qname, label, posint)
+    case "suffix":
+      return expand_label(qname, rewrite["sep"] + label, true, posint)
+    case "prefix":
+      return expand_label(qname, label + rewrite["sep"], false, posint)
+    default:
+      return add_label(qname, label, 1)
+  }
+}
+
+func has_data (msg *dns.Msg) (bool) {
+  // NXDOMAIN and NODATA answers make us try the next name
+  return msg != nil && msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0
+}
+
+func forward_query (r *dns.Msg) (*dns.Msg) {
+  // A copy of the client's query for the backend. Only the OPT record
+  // is kept from the additional section (TSIG is for us, not the backend),
+  // records in the answer and authority sections are dropped.
+  newq := r.Copy()
+  newq.Id = dns.Id()
+  newq.Answer, newq.Ns, newq.Extra = nil, nil, nil
+  if opt := r.IsEdns0(); opt != nil { newq.Extra = append(newq.Extra, opt) }
+  return newq
+}
+
+func rewrite_section (section []dns.RR, from string, to string) ([]dns.RR) {
+  // Replace the rewritten name (and names below it) in owner names and
+  // in names of the record data (e.g. CNAME targets). RRSIGs get the
+  // original owner as well, although their signatures can't be valid for it.
+  for _, rr := range section {
+    // The OPT pseudo record has no name
+    if rr.Header().Rrtype == dns.TypeOPT { continue }
+    rr.Header().Name = replace_name(rr.Header().Name, from, to)
+
+    switch rr := rr.(type) {
+      case *dns.CNAME:
+        rr.Target = replace_name(rr.Target, from, to)
+      case *dns.DNAME:
+        rr.Target = replace_name(rr.Target, from, to)
+      case *dns.NS:
+        rr.Ns = replace_name(rr.Ns, from, to)
+      case *dns.PTR:
+        rr.Ptr = replace_name(rr.Ptr, from, to)
+      case *dns.MX:
+        rr.Mx = replace_name(rr.Mx, from, to)
+      case *dns.SRV:
+        rr.Target = replace_name(rr.Target, from, to)
+      case *dns.SVCB:
+        rr.Target = replace_name(rr.Target, from, to)
+      case *dns.HTTPS:
+        rr.Target = replace_name(rr.Target, from, to)
+      case *dns.NAPTR:
+        rr.Replacement = replace_name(rr.Replacement, from, to)
+      case *dns.SOA:
+        rr.Ns = replace_name(rr.Ns, from, to)
+        rr.Mbox = replace_name(rr.Mbox, from, to)
+    }
+  }
+  return section
+}
+
+func replace_name (name string, from string, to string) (string) {
+  // www.de.example.org -> www.example.org, a.www.de.example.org -> a.www.example.org
+  if len(name) < len(from) || !dns.IsSubDomain(from, name) { return name }
+  prefix := name[:len(name) - len(from)]
+  if !strings.EqualFold(name[len(prefix):], from) || (prefix != "" && !strings.HasSuffix(prefix, ".")) { return name }
+  return prefix + to
 }
 
 func add_label (name string, extra string, pos int) (string) {
@@ -179,13 +494,57 @@ func expand_label (name string, extra string, suffix bool, pos int) (string) {
   return dns.Fqdn(strings.Join(result, `.`))
 }
 
-func get_ip_location (ip string) (string) {
+func get_client_address (w dns.ResponseWriter, r *dns.Msg) (net.IP, *dns.EDNS0_SUBNET) {
   // Input is host:port (e.g. 127.0.0.1:53462), but we need the IP address only
-  host, _, _ := net.SplitHostPort(ip)
+  host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+  remote := net.ParseIP(host)
+
+  // Without EDNS Client Subnet (RFC 7871), the client is the resolver
+  opt := r.IsEdns0()
+  if opt == nil { return remote, nil }
+  for _, option := range opt.Option {
+    subnet, ok := option.(*dns.EDNS0_SUBNET)
+    if !ok { continue }
+
+    // A source prefix length of 0 means the resolver does not want us
+    // to use the client's address, so we use its own (RFC 7871, 7.1.2)
+    if subnet.SourceNetmask == 0 { return remote, subnet }
+    return subnet.Address, subnet
+  }
+
+  return remote, nil
+}
+
+func set_client_subnet (msg *dns.Msg, subnet *dns.EDNS0_SUBNET) {
+  // Answers only depend on the client's location, so they are valid for
+  // the whole subnet the resolver sent (scope = source prefix length),
+  // unless there are overrides for parts of it
+  scope := subnet.SourceNetmask
+  if scope > 0 { scope = uint8(overrides.Load().Scope(subnet.Address, int(scope))) }
+  reply := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET,
+                             Family: subnet.Family,
+                             SourceNetmask: subnet.SourceNetmask,
+                             SourceScope: scope,
+                             Address: subnet.Address}
+
+  opt := msg.IsEdns0()
+  if opt == nil {
+    msg.SetEdns0(dns.DefaultMsgSize, false)
+    opt = msg.IsEdns0()
+  }
+
+  // Replace any ECS option from the backend with ours
+  var options []dns.EDNS0
+  for _, option := range opt.Option {
+    if option.Option() != dns.EDNS0SUBNET { options = append(options, option) }
+  }
+  opt.Option = append(options, reply)
+}
 
-  // Lookup the IP address in the database
-  record, err := geodb.City(net.ParseIP(host))
-  if err != nil { log.Printf("Lookup failed for %s: %s\n", ip, err.Error()); return `` }
+func get_ip_location (ip net.IP) (string, string) {
+  // Lookup the IP address in the database, returns country and continent code
+  record, err := geodb.Load().City(ip)
+  if err != nil { log.Printf("Lookup failed for %s: %s\n", ip, err.Error()); return ``, `` }
 
-  return strings.ToLower(record.Country.IsoCode)
+  return strings.ToLower(record.Country.IsoCode), strings.ToLower(record.Continent.Code)
 }
@@ -0,0 +1,219 @@
+package main
+
+import "io"
+import "log"
+import "net"
+import "os"
+import "strings"
+import "testing"
+import "time"
+import "github.com/miekg/dns"
+
+type testWriter struct {
+  // Collects the responses of handleDnsRequest
+  remote net.Addr
+  written []*dns.Msg
+}
+
+func (w *testWriter) LocalAddr () (net.Addr) { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *testWriter) RemoteAddr () (net.Addr) { return w.remote }
+func (w *testWriter) Close () (error) { return nil }
+func (w *testWriter) TsigStatus () (error) { return nil }
+func (w *testWriter) TsigTimersOnly (bool) {}
+func (w *testWriter) Hijack () {}
+func (w *testWriter) Write (packed []byte) (int, error) { return len(packed), nil }
+
+func (w *testWriter) WriteMsg (msg *dns.Msg) (error) {
+  // Responses must survive the wire format
+  packed, err := msg.Pack()
+  if err != nil { return err }
+  unpacked := new(dns.Msg)
+  if err := unpacked.Unpack(packed); err != nil { return err }
+  w.written = append(w.written, unpacked)
+  return nil
+}
+
+func testBackend (w dns.ResponseWriter, r *dns.Msg) {
+  // Answers every name with a CNAME to a name below it and an address,
+  // names starting with "nx" with NXDOMAIN and names starting with
+  // "empty" with NODATA. Answers refer to the queried name in several
+  // places, so the rewriting of all of them is exercised.
+  msg := new(dns.Msg)
+  msg.SetReply(r)
+  msg.Authoritative = true
+  if len(r.Question) != 1 { msg.Rcode = dns.RcodeFormatError; _ = w.WriteMsg(msg); return }
+  name := r.Question[0].Name
+  below := func(label string) (string) {
+    result := label + "." + strings.TrimPrefix(name, ".")
+    if _, ok := dns.IsDomainName(result); !ok || len(result) > 250 { return name }
+    return result
+  }
+  target := below("target")
+
+  soa := &dns.SOA{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+                  Ns: below("ns1"), Mbox: "hostmaster.example.org.", Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, Minttl: 30}
+  switch {
+    case strings.HasPrefix(name, "nx"):
+      msg.Rcode = dns.RcodeNameError
+      msg.Ns = []dns.RR{soa}
+    case strings.HasPrefix(name, "empty"):
+      msg.Ns = []dns.RR{soa}
+    default:
+      msg.Answer = []dns.RR{
+        &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: target},
+        &dns.A{Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(192, 0, 2, 1)},
+        &dns.RRSIG{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 60},
+                   TypeCovered: dns.TypeCNAME, Algorithm: dns.ECDSAP256SHA256, Labels: uint8(dns.CountLabel(name)),
+                   OrigTtl: 60, Expiration: 2000000000, Inception: 1700000000, KeyTag: 1, SignerName: "example.org.", Signature: "AAAA"},
+      }
+      msg.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60}, Ns: below("ns1")}}
+      msg.Extra = []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: "info.example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: []string{name}}}
+  }
+  if opt := r.IsEdns0(); opt != nil { msg.SetEdns0(opt.UDPSize(), opt.Do()) }
+  _ = w.WriteMsg(msg)
+}
+
+func startTestBackend (t testing.TB) (func()) {
+  // Starts testBackend on a random port and uses it as the only backend
+  started := make(chan bool)
+  conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+  if err != nil { t.Fatal(err) }
+  server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(testBackend), NotifyStartedFunc: func() { close(started) }}
+  go func() { _ = server.ActivateAndServe() }()
+  <-started
+
+  backend, _ := ParseBackend(conn.LocalAddr().String(), time.Second)
+  backends = []*Backend{backend}
+  return func() { _ = server.Shutdown() }
+}
+
+func setupHandler (t testing.TB) (func()) {
+  // Every client gets the label "de" from the overrides, so queries
+  // are rewritten without a GeoIP database
+  log.SetOutput(io.Discard)
+  stop := startTestBackend(t)
+  loaded := &Overrides{}
+  for _, cidr := range []string{"0.0.0.0/0", "::/0"} {
+    _, network, _ := net.ParseCIDR(cidr)
+    loaded.networks = append(loaded.networks, override{network: network, label: "de"})
+  }
+  overrides.Store(loaded)
+  rewrite = map[string]string{"mode": "add", "pos": "1"}
+  nxfallback = true
+  cache = NewCache(1000)
+
+  return func() {
+    stop()
+    overrides.Store(nil)
+    cache = nil
+    log.SetOutput(os.Stderr)
+  }
+}
+
+func checkResponse (t *testing.T, r *dns.Msg, w *testWriter) {
+  // Exactly one response, which belongs to the query and only has the
+  // original name in it
+  if len(w.written) != 1 { t.Fatalf("Got %d responses for %v", len(w.written), r.Question) }
+  in := w.written[0]
+  if in.Id != r.Id || !in.Response { t.Fatalf("Response %d doesn't match query %d", in.Id, r.Id) }
+
+  if len(r.Question) != 1 {
+    if in.Rcode != dns.RcodeFormatError { t.Fatalf("Got %s for %d questions", dns.RcodeToString[in.Rcode], len(r.Question)) }
+    return
+  }
+  if r.Opcode != dns.OpcodeQuery || r.Question[0].Qclass != dns.ClassINET {
+    if in.Rcode != dns.RcodeNotImplemented { t.Fatalf("Got %s for opcode %d, class %d", dns.RcodeToString[in.Rcode], r.Opcode, r.Question[0].Qclass) }
+    return
+  }
+  if len(in.Question) != 1 || in.Question[0] != r.Question[0] { t.Fatalf("Question %v changed to %v", r.Question, in.Question) }
+
+  qname := r.Question[0].Name
+  rewritten := rewrite_name(qname, "de")
+  if rewritten == qname { return }
+  for _, section := range [][]dns.RR{in.Answer, in.Ns, in.Extra} {
+    for _, rr := range section {
+      if rr.Header().Rrtype != dns.TypeOPT && dns.IsSubDomain(rewritten, rr.Header().Name) {
+        t.Fatalf("Rewritten name %s in response: %s", rewritten, rr)
+      }
+    }
+  }
+}
+
+func testQueries () ([]*dns.Msg) {
+  // Seeds for the fuzzer, including malformed queries
+  var queries []*dns.Msg
+  add := func(name string, qtype uint16, change func(*dns.Msg)) {
+    q := new(dns.Msg)
+    q.SetQuestion(name, qtype)
+    if change != nil { change(q) }
+    queries = append(queries, q)
+  }
+
+  add("www.example.org.", dns.TypeA, nil)
+  add("WWW.Example.ORG.", dns.TypeAAAA, func(q *dns.Msg) { q.SetEdns0(1232, true) })
+  add("nx.example.org.", dns.TypeA, nil)
+  add("empty.example.org.", dns.TypeMX, nil)
+  add("a\\.b.example.org.", dns.TypeTXT, nil)
+  add("org.", dns.TypeSOA, nil)
+  add(".", dns.TypeNS, nil)
+  add("www.example.org.", dns.TypeA, func(q *dns.Msg) { q.Question = nil })
+  add("www.example.org.", dns.TypeA, func(q *dns.Msg) { q.Question = append(q.Question, q.Question[0]) })
+  add("version.bind.", dns.TypeTXT, func(q *dns.Msg) { q.Question[0].Qclass = dns.ClassCHAOS })
+  add("www.example.org.", dns.TypeSOA, func(q *dns.Msg) { q.Opcode = dns.OpcodeNotify })
+  add("www.example.org.", dns.TypeA, func(q *dns.Msg) {
+    q.SetEdns0(1232, false)
+    opt := q.IsEdns0()
+    opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(10, 1, 2, 0)})
+  })
+  return queries
+}
+
+func TestHandleDnsRequest (t *testing.T) {
+  defer setupHandler(t)()
+
+  for _, r := range testQueries() {
+    w := &testWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+    handleDnsRequest(w, r)
+    checkResponse(t, r, w)
+  }
+}
+
+func TestRewriteSection (t *testing.T) {
+  // Names below the rewritten name change too, similar names don't
+  rr := func(s string) (dns.RR) { result, _ := dns.NewRR(s); return result }
+  section := []dns.RR{
+    rr("www.de.example.org. 60 IN CNAME a.www.de.example.org."),
+    rr("WWW.DE.example.org. 60 IN MX 10 mx.www.de.example.org."),
+    rr("xwww.de.example.org. 60 IN CNAME www.de.example.org.x."),
+    rr("a\\.www.de.example.org. 60 IN TXT \"www.de.example.org.\""),
+  }
+  expected := []string{
+    "www.example.org.\t60\tIN\tCNAME\ta.www.example.org.",
+    "www.example.org.\t60\tIN\tMX\t10 mx.www.example.org.",
+    "xwww.de.example.org.\t60\tIN\tCNAME\twww.de.example.org.x.",
+    "a\\.www.de.example.org.\t60\tIN\tTXT\t\"www.de.example.org.\"",
+  }
+  for i, result := range rewrite_section(section, "www.de.example.org.", "www.example.org.") {
+    if result.String() != expected[i] { t.Errorf("Got %s, expected %s", result, expected[i]) }
+  }
+}
+
+func FuzzHandleDnsRequest (f *testing.F) {
+  // Any message the server accepts must get exactly one response
+  // without the rewritten name
+  defer setupHandler(f)()
+  for _, q := range testQueries() {
+    packed, err := q.Pack()
+    if err != nil { f.Fatal(err) }
+    f.Add(packed)
+  }
+
+  f.Fuzz(func(t *testing.T, packed []byte) {
+    r := new(dns.Msg)
+    if err := r.Unpack(packed); err != nil || r.Response { return }
+
+    w := &testWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+    handleDnsRequest(w, r)
+    checkResponse(t, r, w)
+  })
+}
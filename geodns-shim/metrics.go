@@ -0,0 +1,116 @@
+package main
+
+import "encoding/json"
+import "log"
+import "net/http"
+import "os"
+import "sync"
+import "time"
+import "github.com/miekg/dns"
+import "github.com/prometheus/client_golang/prometheus"
+import "github.com/prometheus/client_golang/prometheus/promhttp"
+
+type QueryLog struct {
+  // One line of the JSON query log
+  Time time.Time `json:"time"`
+  Client string `json:"client"`
+  Subnet string `json:"ecs,omitempty"`
+  Country string `json:"country"`
+  ASN uint `json:"asn,omitempty"`
+  Override string `json:"override,omitempty"`
+  Name string `json:"qname"`
+  Type string `json:"qtype"`
+  Rewritten string `json:"rewritten,omitempty"`
+  Rcode string `json:"rcode"`
+  LatencyMs float64 `json:"latency_ms"`
+}
+
+var queryCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+  Name: "geodns_queries_total",
+  Help: "Queries answered, by client country, label of the answer and rcode",
+}, []string{"country", "pool", "rcode"})
+
+var backendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+  Name: "geodns_backend_duration_seconds",
+  Help: "Duration of queries to the backends",
+  Buckets: []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5},
+}, []string{"backend"})
+
+var backendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+  Name: "geodns_backend_errors_total",
+  Help: "Queries to the backends which got no response",
+}, []string{"backend"})
+
+// JSON query log, nil if disabled
+var querylog *json.Encoder
+var querylogMutex sync.Mutex
+
+func RegisterMetrics () {
+  prometheus.MustRegister(queryCounter, backendDuration, backendErrors)
+
+  // The hit rate of the cache is hits / (hits + misses)
+  if cache != nil {
+    prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+      Name: "geodns_cache_hits_total",
+      Help: "Queries answered from the cache",
+    }, func() float64 { _, hits, _ := cache.Stats(); return float64(hits) }))
+    prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+      Name: "geodns_cache_misses_total",
+      Help: "Queries sent to a backend",
+    }, func() float64 { _, _, misses := cache.Stats(); return float64(misses) }))
+    prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+      Name: "geodns_cache_entries",
+      Help: "Responses in the cache",
+    }, func() float64 { entries, _, _ := cache.Stats(); return float64(entries) }))
+  }
+}
+
+func ServeMetrics (listen string) {
+  mux := http.NewServeMux()
+  mux.Handle("/metrics", promhttp.Handler())
+
+  log.Printf("Metrics listening on %s\n", listen)
+  log.Println(http.ListenAndServe(listen, mux))
+}
+
+func OpenQueryLog (filename string) (error) {
+  // "-" logs to stdout
+  if filename == "-" {
+    querylog = json.NewEncoder(os.Stdout)
+    return nil
+  }
+
+  file, err := os.OpenFile(filename, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+  if err != nil { return err }
+  querylog = json.NewEncoder(file)
+  return nil
+}
+
+func record_query (entry *QueryLog, pool string, start time.Time) {
+  // Count the query and write it to the query log
+  country, poolname := entry.Country, pool
+  if country == "" { country = "unknown" }
+  if poolname == "" { poolname = "none" }
+  queryCounter.WithLabelValues(country, poolname, entry.Rcode).Inc()
+
+  if querylog == nil { return }
+  entry.Time = start.UTC()
+  entry.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+
+  querylogMutex.Lock()
+  defer querylogMutex.Unlock()
+  if err := querylog.Encode(entry); err != nil { log.Println(err) }
+}
+
+func observe_backend (address string, start time.Time, err error) {
+  if err != nil {
+    backendErrors.WithLabelValues(address).Inc()
+    return
+  }
+  backendDuration.WithLabelValues(address).Observe(time.Since(start).Seconds())
+}
+
+func rcode_name (rcode int) (string) {
+  if name, ok := dns.RcodeToString[rcode]; ok { return name }
+  return "OTHER"
+}
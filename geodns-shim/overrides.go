@@ -0,0 +1,100 @@
+package main
+
+import "bufio"
+import "fmt"
+import "log"
+import "net"
+import "os"
+import "sort"
+import "strings"
+import "sync/atomic"
+
+type override struct {
+  network *net.IPNet
+  label string
+}
+
+type Overrides struct {
+  // Sorted by prefix length, longest first
+  networks []override
+}
+
+// Current overrides, replaced on reload (nil if not configured)
+var overrides atomic.Pointer[Overrides]
+
+func LoadOverrides (filename string) (*Overrides, error) {
+  // Reads lines like "10.0.0.0/8 internal" or "2001:db8::/32 fra".
+  // Empty lines and lines starting with # are ignored.
+  file, err := os.Open(filename)
+  if err != nil { return nil, err }
+  defer file.Close()
+
+  result := &Overrides{}
+  scanner := bufio.NewScanner(file)
+  lineno := 0
+  for scanner.Scan() {
+    lineno++
+    line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+    if line == "" || strings.HasPrefix(line, "#") { continue }
+
+    fields := strings.Fields(line)
+    if len(fields) != 2 || !validlabel.MatchString(fields[1]) {
+      return nil, fmt.Errorf("%s:%d: expected \"network label\"", filename, lineno)
+    }
+
+    // Single addresses are allowed as well
+    cidr := fields[0]
+    if !strings.Contains(cidr, "/") {
+      if strings.Contains(cidr, ":") { cidr += "/128" } else { cidr += "/32" }
+    }
+    _, network, err := net.ParseCIDR(cidr)
+    if err != nil { return nil, fmt.Errorf("%s:%d: %s", filename, lineno, err) }
+
+    result.networks = append(result.networks, override{network: network, label: fields[1]})
+  }
+  if err := scanner.Err(); err != nil { return nil, err }
+
+  sort.SliceStable(result.networks, func(i, j int) bool {
+    ones, _ := result.networks[i].network.Mask.Size()
+    otherones, _ := result.networks[j].network.Mask.Size()
+    return ones > otherones
+  })
+
+  return result, nil
+}
+
+func (o *Overrides) Lookup (ip net.IP) (*net.IPNet, string) {
+  // Longest prefix match, returns the network and its label
+  if o == nil || ip == nil { return nil, "" }
+  for _, entry := range o.networks {
+    if entry.network.Contains(ip) { return entry.network, entry.label }
+  }
+  return nil, ""
+}
+
+func (o *Overrides) Scope (address net.IP, prefix int) (int) {
+  // Overrides for parts of the client subnet make the answer depend
+  // on more bits than the resolver sent (RFC 7871, 7.2.1)
+  scope := prefix
+  if o == nil || address == nil { return scope }
+
+  bits := 8 * net.IPv6len
+  if address.To4() != nil { bits = 8 * net.IPv4len }
+  subnet := &net.IPNet{IP: address.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+  for _, entry := range o.networks {
+    ones, total := entry.network.Mask.Size()
+    if total == bits && ones > scope && subnet.Contains(entry.network.IP) { scope = ones }
+  }
+  return scope
+}
+
+func reload_overrides (filename string) {
+  // Errors keep the current overrides
+  loaded, err := LoadOverrides(filename)
+  if err != nil {
+    log.Printf("Could not reload overrides: %s\n", err)
+    return
+  }
+  overrides.Store(loaded)
+  log.Printf("Loaded %d overrides from %s\n", len(loaded.networks), filename)
+}
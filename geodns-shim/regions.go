@@ -0,0 +1,83 @@
+package main
+
+import "bufio"
+import "fmt"
+import "os"
+import "regexp"
+import "strings"
+
+type Regions struct {
+  // Our own labels for groups of countries and continents
+  countries map[string]string
+  continents map[string]string
+}
+
+// Global mapping, nil if not configured
+var regions *Regions
+
+// Label used when nothing else yields data (optional)
+var defaultlabel string
+
+var validlabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+func LoadRegions (filename string) (*Regions, error) {
+  // Reads lines like "dach: de at ch" or "americas: @na @sa", where
+  // countries are ISO codes and continents are prefixed with @.
+  // Empty lines and lines starting with # are ignored.
+  file, err := os.Open(filename)
+  if err != nil { return nil, err }
+  defer file.Close()
+
+  result := &Regions{countries: make(map[string]string), continents: make(map[string]string)}
+  scanner := bufio.NewScanner(file)
+  lineno := 0
+  for scanner.Scan() {
+    lineno++
+    line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+    if line == "" || strings.HasPrefix(line, "#") { continue }
+
+    label, members, found := strings.Cut(line, ":")
+    label = strings.TrimSpace(label)
+    if !found || !validlabel.MatchString(label) {
+      return nil, fmt.Errorf("%s:%d: expected \"label: members\"", filename, lineno)
+    }
+
+    for _, member := range strings.Fields(members) {
+      mapping, code := result.countries, member
+      if strings.HasPrefix(member, "@") { mapping, code = result.continents, member[1:] }
+      if len(code) != 2 { return nil, fmt.Errorf("%s:%d: invalid code %s", filename, lineno, member) }
+      if other, ok := mapping[code]; ok {
+        return nil, fmt.Errorf("%s:%d: %s is already part of %s", filename, lineno, member, other)
+      }
+      mapping[code] = label
+    }
+  }
+  if err := scanner.Err(); err != nil { return nil, err }
+
+  return result, nil
+}
+
+func location_chain (network string, country string, continent string) ([]string) {
+  // Labels to try in order: the label of the client's network (ASN),
+  // country, its region, continent (or its region) and the default.
+  // Unknown and duplicate labels are skipped.
+  var chain []string
+  add := func(label string) {
+    if label == "" { return }
+    for _, existing := range chain {
+      if existing == label { return }
+    }
+    chain = append(chain, label)
+  }
+
+  add(network)
+  add(country)
+  if regions != nil {
+    add(regions.countries[country])
+    if region, ok := regions.continents[continent]; ok { continent = region }
+  }
+  add(continent)
+  add(defaultlabel)
+
+  return chain
+}
@@ -0,0 +1,42 @@
+package main
+
+import "crypto/tls"
+import "crypto/x509"
+import "fmt"
+import "log"
+import "sync/atomic"
+
+// Current certificate for DoT and DoH, replaced on reload
+var certificate atomic.Pointer[tls.Certificate]
+
+func LoadCertificate (certfile string, keyfile string) (*tls.Certificate, error) {
+  // The certificate file may contain the chain after our certificate
+  cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+  if err != nil { return nil, fmt.Errorf("%s: %s", certfile, err) }
+
+  leaf, err := x509.ParseCertificate(cert.Certificate[0])
+  if err != nil { return nil, fmt.Errorf("%s: %s", certfile, err) }
+  cert.Leaf = leaf
+
+  log.Printf("Loaded certificate %s for %s (valid until %s)\n", certfile, leaf.Subject.CommonName, leaf.NotAfter.UTC().Format("2006-01-02"))
+  return &cert, nil
+}
+
+func reload_certificate (certfile string, keyfile string) {
+  // Errors keep the current certificate
+  cert, err := LoadCertificate(certfile, keyfile)
+  if err != nil {
+    log.Printf("Could not reload certificate: %s\n", err)
+    return
+  }
+  certificate.Store(cert)
+}
+
+func tls_config () (*tls.Config) {
+  // Connections get the certificate which is current when they are
+  // established, so renewed certificates are used after SIGHUP
+  return &tls.Config{
+    MinVersion: tls.VersionTLS12,
+    GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return certificate.Load(), nil },
+  }
+}